@@ -0,0 +1,616 @@
+// Framework for chat bots that talk to the chat server (./server.go) over the normal chat protocol
+// A bot has one connection for each room it joins (so it hears everything said in those rooms) and reacts to
+// - commands: "!deploy status" calls the "deploy" handler with the arguments ["status"]
+// - triggers: messages matching a regular expression
+// - schedules: handlers called every interval or at the same time each day
+// Each room has its own state and lost connections are resumed (or joined again) with backoff
+//
+// see ../echobot.go for an example
+package bot
+
+import (
+  "bufio"
+  "fmt"
+  "net"
+  "regexp"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+  "../util"
+)
+
+// the room the server puts us in when we aren't in a private room
+const LOBBY = "lobby"
+// the default prefix of bot commands ("!help")
+const COMMAND_PREFIX = "!"
+
+// chat server command /command [username] {id timestamp} body contents
+var chatServerResponseRegex, _ = regexp.Compile(`^\/([^\s]*)\s?(?:\[([^\]]*)\])?\s*(?:\{(\d+) (\d+)\}\s?)?(.*)$`)
+
+// a chat message the bot has received
+type Message struct {
+  // the server assigned id of the message
+  ID int64
+  // who sent the message
+  Username string
+  // the room the message was sent to ("lobby" for the lobby)
+  Room string
+  // the message text
+  Text string
+  // the id of the message this is a reply to (0 if it isn't a reply)
+  ReplyTo int64
+  // true if the message was sent only to the bot ("/msg")
+  Direct bool
+  // when the message was sent
+  Time time.Time
+}
+
+// what a handler is called with
+type Context struct {
+  Bot *Bot
+  // the message that called the handler (only the room is set for scheduled handlers)
+  Message Message
+  // the words after the command name ("!deploy status now" -> ["status", "now"])
+  Args []string
+  // the trigger's regular expression matches (the whole match followed by the groups)
+  Matches []string
+}
+
+// called for commands, triggers and schedules
+type Handler func(ctx *Context)
+
+// a "!{name}" command
+type command struct {
+  name string
+  help string
+  handler Handler
+}
+
+// a pattern matched against every message
+type trigger struct {
+  pattern *regexp.Regexp
+  handler Handler
+}
+
+// a handler called at the times returned by next
+type schedule struct {
+  room string
+  next func(now time.Time) time.Time
+  handler Handler
+}
+
+// values kept for a room
+type State struct {
+  lock sync.Mutex
+  values map[string]interface{}
+}
+
+// a chat bot (create with New, add commands, triggers and schedules and then call Run)
+type Bot struct {
+  Username string
+  // what commands start with (COMMAND_PREFIX by default)
+  Prefix string
+  props util.Properties
+  lock sync.RWMutex
+  commands map[string]*command
+  triggers []*trigger
+  schedules []*schedule
+  // room -> connection to that room (the first room also receives direct messages)
+  rooms map[string]*roomConnection
+  roomOrder []string
+  states map[string]*State
+  // closed by Stop
+  done chan struct{}
+  stopOnce sync.Once
+}
+
+// a connection to the server for one room
+type roomConnection struct {
+  bot *Bot
+  room string
+  // true if direct messages are handled by this connection (they are sent to every connection of the bot)
+  primary bool
+  lock sync.Mutex
+  conn net.Conn
+  session string
+}
+
+// create a bot which connects to the server in the properties (Hostname and Port) as the user
+// lost connections are retried every ReconnectDelay seconds (doubling up to ReconnectMaxDelay)
+func New(username string, props util.Properties) *Bot {
+  return &Bot{
+    Username: username,
+    Prefix: COMMAND_PREFIX,
+    props: props,
+    commands: map[string]*command{},
+    rooms: map[string]*roomConnection{},
+    states: map[string]*State{},
+    done: make(chan struct{}),
+  }
+}
+
+// add rooms for the bot to be in (the bot is in the lobby if no rooms are added)
+// rooms should be joined before calling Run
+func (bot *Bot) Join(rooms ...string) {
+  bot.lock.Lock()
+  defer bot.lock.Unlock()
+  for _, room := range rooms {
+    if (room == "") {
+      room = LOBBY
+    }
+    if _, ok := bot.rooms[room]; !ok {
+      bot.rooms[room] = &roomConnection{bot: bot, room: room, primary: len(bot.roomOrder) == 0}
+      bot.roomOrder = append(bot.roomOrder, room)
+    }
+  }
+}
+
+// call the handler for messages starting with the prefix and name ("!deploy status")
+func (bot *Bot) Command(name string, help string, handler Handler) {
+  bot.lock.Lock()
+  defer bot.lock.Unlock()
+  bot.commands[name] = &command{name: name, help: help, handler: handler}
+}
+
+// call the handler for messages (that aren't commands) matching the regular expression
+func (bot *Bot) Trigger(pattern string, handler Handler) error {
+  compiled, err := regexp.Compile(pattern)
+  if (err != nil) {
+    return err
+  }
+  bot.lock.Lock()
+  defer bot.lock.Unlock()
+  bot.triggers = append(bot.triggers, &trigger{pattern: compiled, handler: handler})
+  return nil
+}
+
+// call the handler for the room every interval (starting one interval after Run is called)
+func (bot *Bot) Every(room string, interval time.Duration, handler Handler) {
+  bot.addSchedule(room, func(now time.Time) time.Time {
+    return now.Add(interval)
+  }, handler)
+}
+
+// call the handler for the room at the same (local) time every day ("09:30")
+func (bot *Bot) Daily(room string, at string, handler Handler) error {
+  clock, err := time.Parse("15:04", at)
+  if (err != nil) {
+    return fmt.Errorf("Daily time must be HH:MM: %v", err)
+  }
+  bot.addSchedule(room, func(now time.Time) time.Time {
+    next := time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), 0, 0, now.Location())
+    if (!next.After(now)) {
+      next = next.AddDate(0, 0, 1)
+    }
+    return next
+  }, handler)
+  return nil
+}
+
+func (bot *Bot) addSchedule(room string, next func(now time.Time) time.Time, handler Handler) {
+  if (room == "") {
+    room = LOBBY
+  }
+  bot.lock.Lock()
+  defer bot.lock.Unlock()
+  bot.schedules = append(bot.schedules, &schedule{room: room, next: next, handler: handler})
+}
+
+// connect to every room and handle messages until Stop is called
+// an error is returned if a connection is lost and reconnecting is turned off (ReconnectDelay is 0)
+func (bot *Bot) Run() error {
+  bot.lock.RLock()
+  noRooms := len(bot.roomOrder) == 0
+  bot.lock.RUnlock()
+  if (noRooms) {
+    bot.Join(LOBBY)
+  }
+  if _, ok := bot.findCommand("help"); !ok {
+    bot.Command("help", "list the commands", bot.help)
+  }
+
+  bot.lock.RLock()
+  rooms := []*roomConnection{}
+  for _, room := range bot.roomOrder {
+    rooms = append(rooms, bot.rooms[room])
+  }
+  schedules := bot.schedules
+  bot.lock.RUnlock()
+
+  for _, schedule := range schedules {
+    go bot.runSchedule(schedule)
+  }
+
+  errors := make(chan error, len(rooms))
+  for _, room := range rooms {
+    go func(room *roomConnection) {
+      errors <- room.run()
+    }(room)
+  }
+
+  var rtn error
+  for range rooms {
+    if err := <-errors; err != nil && rtn == nil {
+      rtn = err
+      bot.Stop()
+    }
+  }
+  return rtn
+}
+
+// disconnect from the server (Run returns once every connection is closed)
+func (bot *Bot) Stop() {
+  bot.stopOnce.Do(func() {
+    close(bot.done)
+    bot.lock.RLock()
+    defer bot.lock.RUnlock()
+    for _, room := range bot.rooms {
+      room.close()
+    }
+  })
+}
+
+// return true once Stop has been called
+func (bot *Bot) stopped() bool {
+  select {
+    case <-bot.done:
+      return true
+    default:
+      return false
+  }
+}
+
+// send a message to a room the bot is in (each line is sent as its own message)
+func (bot *Bot) Say(room string, text string) error {
+  if (room == "") {
+    room = LOBBY
+  }
+  bot.lock.RLock()
+  connection, ok := bot.rooms[room]
+  bot.lock.RUnlock()
+  if (!ok) {
+    return fmt.Errorf("The bot isn't in room %v", room)
+  }
+  for _, line := range strings.Split(text, "\n") {
+    if (strings.TrimSpace(line) == "") {
+      continue
+    }
+    if err := connection.send("message", line); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// send a message to only one user (each line is sent as its own message)
+// an error is returned if the bot hasn't joined any rooms (direct messages use the first room's connection)
+func (bot *Bot) Direct(username string, text string) error {
+  bot.lock.RLock()
+  var connection *roomConnection
+  if (len(bot.roomOrder) > 0) {
+    connection = bot.rooms[bot.roomOrder[0]]
+  }
+  bot.lock.RUnlock()
+  if (connection == nil) {
+    return fmt.Errorf("The bot isn't in any rooms")
+  }
+  for _, line := range strings.Split(text, "\n") {
+    if (strings.TrimSpace(line) == "") {
+      continue
+    }
+    if err := connection.send("msg", username + " " + line); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// return the values kept for a room
+func (bot *Bot) State(room string) *State {
+  if (room == "") {
+    room = LOBBY
+  }
+  bot.lock.Lock()
+  defer bot.lock.Unlock()
+  state, ok := bot.states[room]
+  if (!ok) {
+    state = &State{values: map[string]interface{}{}}
+    bot.states[room] = state
+  }
+  return state
+}
+
+// answer the message (in the room it was sent to or directly if it was a direct message)
+func (ctx *Context) Reply(text string) error {
+  if (ctx.Message.Direct) {
+    return ctx.Bot.Direct(ctx.Message.Username, text)
+  }
+  return ctx.Bot.Say(ctx.Message.Room, text)
+}
+
+// return the values kept for the room of the message
+func (ctx *Context) State() *State {
+  return ctx.Bot.State(ctx.Message.Room)
+}
+
+// return the value for the key (false if it isn't set)
+func (state *State) Get(key string) (interface{}, bool) {
+  state.lock.Lock()
+  defer state.lock.Unlock()
+  value, ok := state.values[key]
+  return value, ok
+}
+
+// set the value for the key
+func (state *State) Set(key string, value interface{}) {
+  state.lock.Lock()
+  defer state.lock.Unlock()
+  state.values[key] = value
+}
+
+// remove the value for the key
+func (state *State) Delete(key string) {
+  state.lock.Lock()
+  defer state.lock.Unlock()
+  delete(state.values, key)
+}
+
+// change the values while no one else can (like adding to a score)
+func (state *State) Update(update func(values map[string]interface{})) {
+  state.lock.Lock()
+  defer state.lock.Unlock()
+  update(state.values)
+}
+
+// list the commands ("!help")
+func (bot *Bot) help(ctx *Context) {
+  bot.lock.RLock()
+  names := []string{}
+  for name := range bot.commands {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  lines := []string{}
+  for _, name := range names {
+    lines = append(lines, fmt.Sprintf("%v%v - %v", bot.Prefix, name, bot.commands[name].help))
+  }
+  bot.lock.RUnlock()
+  ctx.Reply(strings.Join(lines, "\n"))
+}
+
+func (bot *Bot) findCommand(name string) (*command, bool) {
+  bot.lock.RLock()
+  defer bot.lock.RUnlock()
+  command, ok := bot.commands[name]
+  return command, ok
+}
+
+// call the command or the matching triggers for a message
+func (bot *Bot) dispatch(message Message) {
+  if (message.Username == bot.Username || message.Username == "") {
+    return
+  }
+
+  if (strings.HasPrefix(message.Text, bot.Prefix)) {
+    words := strings.Fields(strings.TrimPrefix(message.Text, bot.Prefix))
+    if (len(words) > 0) {
+      if command, ok := bot.findCommand(words[0]); ok {
+        bot.call(command.handler, &Context{Bot: bot, Message: message, Args: words[1:]})
+        return
+      }
+    }
+  }
+
+  bot.lock.RLock()
+  triggers := bot.triggers
+  bot.lock.RUnlock()
+  for _, trigger := range triggers {
+    if matches := trigger.pattern.FindStringSubmatch(message.Text); matches != nil {
+      bot.call(trigger.handler, &Context{Bot: bot, Message: message, Matches: matches})
+    }
+  }
+}
+
+// call a handler in its own goroutine so slow handlers don't hold up the connection
+// (a handler that panics is logged rather than stopping the bot)
+func (bot *Bot) call(handler Handler, ctx *Context) {
+  go func() {
+    defer func() {
+      if err := recover(); err != nil {
+        util.Errorf("Bot handler failed: %v", err)
+      }
+    }()
+    handler(ctx)
+  }()
+}
+
+// call the schedule's handler at each of its times until the bot is stopped
+func (bot *Bot) runSchedule(schedule *schedule) {
+  for {
+    timer := time.NewTimer(time.Until(schedule.next(time.Now())))
+    select {
+      case <-bot.done:
+        timer.Stop()
+        return
+      case <-timer.C:
+        bot.call(schedule.handler, &Context{Bot: bot, Message: Message{Room: schedule.room, Time: time.Now()}})
+    }
+  }
+}
+
+// stay connected to the room (reconnecting with backoff) until the bot is stopped
+func (room *roomConnection) run() error {
+  address := room.bot.props.Hostname + ":" + room.bot.props.Port
+  initialDelay := time.Duration(room.bot.props.ReconnectDelay) * time.Second
+  maxDelay := time.Duration(room.bot.props.ReconnectMaxDelay) * time.Second
+  delay := initialDelay
+
+  for {
+    conn, err := net.Dial("tcp", address)
+    joined := false
+    if (err == nil) {
+      room.setConnection(conn)
+      if (room.bot.stopped()) {
+        // stopped while we were connecting
+        conn.Close()
+        return nil
+      }
+      joined, err = room.watch(conn)
+      conn.Close()
+    }
+    if (room.bot.stopped()) {
+      return nil
+    }
+    if (initialDelay <= 0) {
+      return err
+    }
+    if (joined) {
+      delay = initialDelay
+    }
+
+    util.Warnf("Bot %v lost the connection to %v (%v), reconnecting in %v", room.bot.Username, room.room, err, delay)
+    select {
+      case <-room.bot.done:
+        return nil
+      case <-time.After(delay):
+    }
+    delay *= 2
+    if (delay > maxDelay) {
+      delay = maxDelay
+    }
+  }
+}
+
+// handle what the server sends until the connection is lost
+// joined is true if we got into the room
+func (room *roomConnection) watch(conn net.Conn) (joined bool, err error) {
+  reader := bufio.NewReader(conn)
+  for {
+    line, err := reader.ReadString('\n')
+    if (err != nil) {
+      return joined, err
+    }
+    line = strings.TrimSpace(line)
+    if (line == "") {
+      continue
+    }
+
+    res := chatServerResponseRegex.FindStringSubmatch(line)
+    if (res == nil) {
+      continue
+    }
+    name, username, body := util.Decode(res[1]), util.Decode(res[2]), util.Decode(res[5])
+    message := Message{Username: username, Room: room.room, Text: body, Time: time.Now()}
+    if (res[3] != "") {
+      message.ID, _ = strconv.ParseInt(res[3], 10, 64)
+      seconds, _ := strconv.ParseInt(res[4], 10, 64)
+      message.Time = time.Unix(seconds, 0)
+    }
+
+    switch name {
+      // the handshake - send our protocol version and then resume our session or join
+      case "ready":
+        room.send("protocol", strconv.Itoa(util.PROTOCOL_VERSION))
+        if (room.token() != "") {
+          room.send("resume", room.token())
+        } else {
+          room.join()
+        }
+
+      // the server has given us a session we can resume if we lose the connection
+      case "session":
+        room.lock.Lock()
+        room.session = body
+        room.lock.Unlock()
+        joined = true
+
+      case "resumed":
+        joined = true
+
+      // heartbeat - let the server know we are still here
+      case "ping":
+        room.send("pong", body)
+
+      case "message":
+        room.bot.dispatch(message)
+
+      // "/reply [{username}] {{id} {time}} {parent id} {message}"
+      case "reply":
+        first, rest := splitFirst(body)
+        message.ReplyTo, _ = strconv.ParseInt(first, 10, 64)
+        message.Text = rest
+        room.bot.dispatch(message)
+
+      case "direct":
+        if (room.primary) {
+          message.Direct = true
+          room.bot.dispatch(message)
+        }
+
+      case "error":
+        code, detail := splitFirst(body)
+        if (code == "session-expired") {
+          // the server doesn't remember us (it may have restarted) so join again
+          room.lock.Lock()
+          room.session = ""
+          room.lock.Unlock()
+          room.join()
+        } else {
+          util.Warnf("Bot %v in %v got error %v %v", room.bot.Username, room.room, code, detail)
+        }
+    }
+  }
+}
+
+// send our username and go to the room
+func (room *roomConnection) join() {
+  room.send("user", room.bot.Username)
+  if (room.room != LOBBY) {
+    room.send("enter", room.room)
+  }
+}
+
+// send a command to the chat server on this room's connection
+func (room *roomConnection) send(command string, body string) error {
+  room.lock.Lock()
+  conn := room.conn
+  room.lock.Unlock()
+  if (conn == nil) {
+    return fmt.Errorf("The bot isn't connected to room %v", room.room)
+  }
+  _, err := fmt.Fprintf(conn, "/%v %v\n", util.Encode(command), util.Encode(body))
+  return err
+}
+
+func (room *roomConnection) setConnection(conn net.Conn) {
+  room.lock.Lock()
+  defer room.lock.Unlock()
+  room.conn = conn
+}
+
+func (room *roomConnection) token() string {
+  room.lock.Lock()
+  defer room.lock.Unlock()
+  return room.session
+}
+
+// say goodbye and close the connection (the session is ended so it can't be resumed)
+func (room *roomConnection) close() {
+  room.send("disconnect", "")
+  room.lock.Lock()
+  defer room.lock.Unlock()
+  if (room.conn != nil) {
+    room.conn.Close()
+  }
+}
+
+// split content into the first word and the rest of the content
+func splitFirst(body string) (string, string) {
+  parts := strings.SplitN(strings.TrimSpace(body), " ", 2)
+  if (len(parts) == 1) {
+    return parts[0], ""
+  }
+  return parts[0], strings.TrimSpace(parts[1])
+}
@@ -0,0 +1,106 @@
+package bot
+
+import (
+  "bufio"
+  "fmt"
+  "net"
+  "path/filepath"
+  "strings"
+  "testing"
+  "time"
+  "../server"
+  "../util"
+)
+
+// start a chat server in the test and return the properties a bot connects to it with
+func startServer(t *testing.T) util.Properties {
+  dir := t.TempDir()
+  t.Setenv("CHAT_MAILBOX_FILE", filepath.Join(dir, "mailbox.json"))
+  t.Setenv("CHAT_BAN_FILE", filepath.Join(dir, "bans.json"))
+  // the tests talk faster than people do
+  t.Setenv("CHAT_MESSAGES_PER_MINUTE", "0")
+  t.Setenv("CHAT_COMMANDS_PER_MINUTE", "0")
+  listener, err := net.Listen("tcp", "127.0.0.1:0")
+  if (err != nil) {
+    t.Fatal(err)
+  }
+  t.Cleanup(func() {
+    listener.Close()
+  })
+  go server.Serve(listener)
+
+  _, port, _ := net.SplitHostPort(listener.Addr().String())
+  return util.Properties{Hostname: "127.0.0.1", Port: port}
+}
+
+// a user talking to the bot
+type user struct {
+  conn net.Conn
+  reader *bufio.Reader
+}
+
+func connect(t *testing.T, props util.Properties, username string) *user {
+  conn, err := net.Dial("tcp", props.Hostname + ":" + props.Port)
+  if (err != nil) {
+    t.Fatal(err)
+  }
+  t.Cleanup(func() {
+    conn.Close()
+  })
+  fmt.Fprintf(conn, "/protocol %v\n/user %v\n", util.PROTOCOL_VERSION, username)
+  return &user{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (user *user) say(text string) {
+  fmt.Fprintf(user.conn, "/message %v\n", util.Encode(text))
+}
+
+// wait for a line from the server starting with the prefix and ending with the suffix
+func (user *user) expect(t *testing.T, prefix string, suffix string) {
+  t.Helper()
+  user.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+  for {
+    line, err := user.reader.ReadString('\n')
+    if (err != nil) {
+      t.Fatalf("expected %q ... %q: %v", prefix, suffix, err)
+    }
+    line = strings.TrimSpace(line)
+    if (strings.HasPrefix(line, prefix) && strings.HasSuffix(line, suffix)) {
+      return
+    }
+  }
+}
+
+func TestBotAnswersCommandsTriggersAndSchedules(t *testing.T) {
+  props := startServer(t)
+  ann := connect(t, props, "ann")
+  ann.expect(t, "/session", "")
+
+  helper := New("helper", props)
+  helper.Command("echo", "repeat the rest of the message", func(ctx *Context) {
+    ctx.Reply(strings.Join(ctx.Args, " "))
+  })
+  helper.Trigger(`(?i)^hello`, func(ctx *Context) {
+    ctx.Reply("hi " + ctx.Message.Username)
+  })
+  helper.Every(LOBBY, 500 * time.Millisecond, func(ctx *Context) {
+    ctx.Reply("tick")
+  })
+  go helper.Run()
+  defer helper.Stop()
+  ann.expect(t, "/connect [helper]", "")
+
+  ann.say("!echo one two")
+  ann.expect(t, "/message [helper]", " one two")
+
+  ann.say("Hello there")
+  ann.expect(t, "/message [helper]", " hi ann")
+
+  ann.expect(t, "/message [helper]", " tick")
+}
+
+func TestDirectWithoutRooms(t *testing.T) {
+  if err := New("helper", util.Properties{}).Direct("ann", "hi"); err == nil {
+    t.Errorf("expected an error when the bot isn't in any rooms")
+  }
+}
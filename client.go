@@ -1,5 +1,6 @@
 // A simple chat client to talk to the simple chat server (./server.go)
 // To run the client, use "go run client.go {username}" where username is your username
+// (config flags like "-config" or "-hostname" must come before the username)
 // This will listen for chat room events and display them
 // (someone entered the room, left the room, or chatted something)
 // To chat a message, simply type something after you run the program and press the enter key
@@ -10,44 +11,179 @@ package main
 
 import (
   "fmt"
+  "flag"
   "os"
   "net"
   "bufio"
   "regexp"
+  "sort"
+  "strconv"
   "strings"
+  "sync"
+  "time"
   "./util"
+  "./i18n"
+  "./tui"
+  "./commands"
 )
 
 // input message regular expression (look for a command /whatever)
 var standardInputMessageRegex, _ = regexp.Compile(`^\/([^\s]*)\s*(.*)$`)
-// chat server command /command [username] body contents
-var chatServerResponseRegex, _ = regexp.Compile(`^\/([^\s]*)\s?(?:\[([^\]]*)\])?\s*(.*)$`)
+// terminal codes used to highlight chat events that mention us
+const HIGHLIGHT_START = "\x1b[1;33m"
+const HIGHLIGHT_END = "\x1b[0m"
+// the room the server puts us in when we aren't in a private room
+const LOBBY = "lobby"
+
+// chat server command /command [username] {id timestamp} body contents
+var chatServerResponseRegex, _ = regexp.Compile(`^\/([^\s]*)\s?(?:\[([^\]]*)\])?\s*(?:\{(\d+) (\d+)\}\s?)?(.*)$`)
 
 // container for chat server Command details
 type Command struct {
   // "leave", "message", "enter"
   Command, Username, Body string
+  // the server assigned id of the action (0 if not provided)
+  ID int64
+  // when the action happened on the server (now if not provided)
+  Time time.Time
 }
 
+// the messages used to display chat events
+var messages *i18n.Catalog
+// time format shown before chat events (nothing is shown if empty)
+var timestampFormat string
+// ring the terminal bell when we are mentioned
+var mentionBell bool
+
+// the current chat server connection (replaced when we reconnect)
+var connection net.Conn
+// true once we have been disconnected on purpose (so we don't reconnect)
+var isQuitting bool
+var connectionLock sync.Mutex
+
+// what we need to pick up where we left off when we reconnect (only used by the connection watcher)
+// the server session token, the room we are in ("" for the lobby) and who we are ignoring
+var sessionToken string
+var currentRoom string
+var ignoring = []string{}
+// username -> room of everyone connected (updated by the connection watcher)
+var roster = map[string]string{}
+var rosterLock sync.Mutex
+
+// the console commands
+var registry = commands.New()
+
+// the full screen terminal UI (nil unless the TUI config value is set)
+var screen *tui.Screen
+
 // program main
 func main() {
   username, properties := getConfig();
 
-  conn, err := net.Dial("tcp", properties.Hostname + ":" + properties.Port)
+  var err error
+  messages, err = i18n.Load(i18n.DetectLocale(properties.Locale), properties.LocaleDir)
+  util.CheckForError(err, "Can't load messages")
+  timestampFormat = properties.TimestampFormat
+  mentionBell = properties.MentionBell
+  registerCommands(properties)
+
+  address := properties.Hostname + ":" + properties.Port
+  conn, err := net.Dial("tcp", address)
   util.CheckForError(err, "Connection refused")
-  defer conn.Close()
+
+  if (properties.TUI) {
+    screen, err = tui.Start()
+    util.CheckForError(err, "Can't start the terminal UI")
+    setStatus("status-connecting", i18n.Data{User: username})
+    screen.SetCompleter(registry.Complete)
+  }
 
   // we're listening to chat server commands *and* user terminal commands
-  go watchForConnectionInput(username, properties, conn)
-  for true {
-    watchForConsoleInput(conn)
+  go watchForConsoleInput()
+
+  // reconnect (waiting longer after each failed attempt) whenever the connection is lost
+  initialDelay := time.Duration(properties.ReconnectDelay) * time.Second
+  maxDelay := time.Duration(properties.ReconnectMaxDelay) * time.Second
+  delay := initialDelay
+  for {
+    setConnection(conn)
+    joined, err := watchForConnectionInput(username, conn)
+    conn.Close()
+    if (quitting()) {
+      exit(0)
+    }
+    if (initialDelay <= 0) {
+      checkForError(err, "Lost server connection")
+    }
+    if (joined) {
+      delay = initialDelay
+    }
+
+    for {
+      output(messages.Render("reconnecting", i18n.Data{Detail: delay.String()}))
+      setStatus("status-reconnecting", i18n.Data{User: username, Detail: delay.String()})
+      time.Sleep(delay)
+      delay *= 2
+      if (delay > maxDelay) {
+        delay = maxDelay
+      }
+      conn, err = net.Dial("tcp", address)
+      if (err == nil) {
+        break
+      }
+    }
   }
 }
 
+// give the terminal back (if we are using the terminal UI) and exit
+func exit(code int) {
+  if (screen != nil) {
+    screen.Stop()
+  }
+  os.Exit(code)
+}
+
+// exit with the message if there is an error (giving the terminal back first)
+func checkForError(err error, message string) {
+  if (err != nil && screen != nil) {
+    screen.Stop()
+  }
+  util.CheckForError(err, message)
+}
+
+// use a new chat server connection for our commands
+func setConnection(conn net.Conn) {
+  connectionLock.Lock()
+  defer connectionLock.Unlock()
+  connection = conn
+}
+
+// return the current chat server connection
+func currentConnection() net.Conn {
+  connectionLock.Lock()
+  defer connectionLock.Unlock()
+  return connection
+}
+
+// don't reconnect when the connection is closed (we disconnected, were kicked or banned)
+func quit() {
+  connectionLock.Lock()
+  defer connectionLock.Unlock()
+  isQuitting = true
+}
+
+// return true if we shouldn't reconnect
+func quitting() bool {
+  connectionLock.Lock()
+  defer connectionLock.Unlock()
+  return isQuitting
+}
+
 // parse out the arguments to be used when connecting to the chat server
 func getConfig() (string, util.Properties) {
-  if (len(os.Args) >= 2) {
-    username := os.Args[1]
+  util.ParseFlags()
+  if (flag.NArg() >= 1) {
+    username := flag.Arg(0)
     properties := util.LoadConfig()
     return username, properties
   } else {
@@ -59,93 +195,528 @@ func getConfig() (string, util.Properties) {
 
 // keep watching for console input
 // send the "message" command to the chat server when we have some
-func watchForConsoleInput(conn net.Conn) {
+func watchForConsoleInput() {
   reader := bufio.NewReader(os.Stdin)
 
   for true {
-    message, err := reader.ReadString('\n')
-    util.CheckForError(err, "Lost console connection")
+    var message string
+    var err error
+    if (screen != nil) {
+      message, err = screen.ReadLine()
+      if (err == tui.ErrInterrupted) {
+        // Ctrl-C - leave the chat server
+        quit()
+        sendCommand("disconnect", "", currentConnection())
+        exit(0)
+      }
+    } else {
+      message, err = reader.ReadString('\n')
+    }
+    checkForError(err, "Lost console connection")
 
     message = strings.TrimSpace(message)
     if (message != "") {
+      conn := currentConnection()
       command := parseInput(message)
 
       if (command.Command == "") {
         // there is no command so treat this as a simple message to be sent out
         sendCommand("message", message, conn);
-      } else {
-        switch command.Command {
+      } else if (!registry.Run(command.Command, command.Body)) {
+        output(messages.Render("unknown-command", i18n.Data{Body: command.Command}))
+      }
+    }
+  }
+}
 
-          // enter a room
-          case "enter":
-            sendCommand("enter", command.Body, conn)
+// add the console commands (and the user defined aliases) to the registry
+func registerCommands(properties util.Properties) {
+  // commands that are sent to the chat server as they are
+  send := func(name string) func(string) {
+    return func(body string) {
+      sendCommand(name, body, currentConnection())
+    }
+  }
+  user := commands.Arg{Name: "username", Kind: commands.ARG_USER}
+  id := commands.Arg{Name: "id"}
+  text := func(name string) commands.Arg {
+    return commands.Arg{Name: name, Rest: true}
+  }
 
-          // ignore someone
-          case "ignore":
-            sendCommand("ignore", command.Body, conn)
+  registry.Register(commands.Command{Name: "message", Aliases: []string{"say"}, Args: []commands.Arg{text("message")},
+      Run: send("message"), Help: "send a message to your room (the same as typing it without a command)"})
+  registry.Register(commands.Command{Name: "enter", Aliases: []string{"join"}, Run: send("enter"),
+      Args: []commands.Arg{{Name: "room", Kind: commands.ARG_ROOM}},
+      Help: "enter a private room (only people in the room will see your messages)"})
+  registry.Register(commands.Command{Name: "leave", Aliases: []string{"part"},
+      Run: func(body string) {
+        // leave the current room (we aren't allowing multiple rooms)
+        sendCommand("leave", "", currentConnection())
+      },
+      Help: "leave your private room and go back to the lobby"})
+  registry.Register(commands.Command{Name: "ignore", Args: []commands.Arg{user}, Run: send("ignore"),
+      Help: "stop seeing messages from someone"})
+  registry.Register(commands.Command{Name: "disconnect", Aliases: []string{"quit", "exit"},
+      Run: func(body string) {
+        quit()
+        sendCommand("disconnect", "", currentConnection())
+      },
+      Help: "disconnect from the chat server"})
+  registry.Register(commands.Command{Name: "edit", Args: []commands.Arg{id, text("message")}, Run: send("edit"),
+      Help: "change one of your messages"})
+  registry.Register(commands.Command{Name: "delete", Args: []commands.Arg{id}, Run: send("delete"),
+      Help: "remove one of your messages"})
+  registry.Register(commands.Command{Name: "reply", Args: []commands.Arg{id, text("message")}, Run: send("reply"),
+      Help: "reply to a message"})
+  registry.Register(commands.Command{Name: "react", Args: []commands.Arg{id, {Name: "reaction"}}, Run: send("react"),
+      Help: "react to a message with an emoji or short word"})
+  registry.Register(commands.Command{Name: "msg", Aliases: []string{"whisper", "w"}, Run: send("msg"),
+      Args: []commands.Arg{user, text("message")},
+      Help: "send a message to only one user (it is kept for them if they are offline)"})
+  registry.Register(commands.Command{Name: "inbox", Run: send("inbox"),
+      Args: []commands.Arg{{Name: "clear", Optional: true, Choices: []string{"clear"}}},
+      Help: "show (or clear) the messages left for you while you were offline"})
+  registry.Register(commands.Command{Name: "who", Run: send("who"),
+      Help: "list everyone that is connected and the room they are in"})
+  registry.Register(commands.Command{Name: "history", Run: send("history"),
+      Args: []commands.Arg{{Name: "count", Optional: true}},
+      Help: "show the most recent messages in your room"})
+  registry.Register(commands.Command{Name: "search", Args: []commands.Arg{text("query")}, Run: send("search"),
+      Help: "search the messages in your room (\"quoted phrases\", OR and AND are supported)"})
+  registry.Register(commands.Command{Name: "auth", Args: []commands.Arg{{Name: "password"}}, Run: send("auth"),
+      Help: "provide the password for your admin or moderator role"})
+  registry.Register(commands.Command{Name: "kick", Args: []commands.Arg{user}, Run: send("kick"),
+      Help: "disconnect a user (moderators only)"})
+  registry.Register(commands.Command{Name: "mute", Args: []commands.Arg{user, {Name: "duration"}}, Run: send("mute"),
+      Help: "stop a user from talking for a while, like 10m or 1h (moderators only)"})
+  registry.Register(commands.Command{Name: "ban", Args: []commands.Arg{{Name: "username|ip", Kind: commands.ARG_USER}},
+      Run: send("ban"), Help: "disconnect and ban a username or IP address (moderators only)"})
+  registry.Register(commands.Command{Name: "unban", Args: []commands.Arg{{Name: "username|ip"}}, Run: send("unban"),
+      Help: "remove a ban (moderators only)"})
+  registry.Register(commands.Command{Name: "help", Aliases: []string{"?"}, Run: showHelp,
+      Args: []commands.Arg{{Name: "command", Kind: commands.ARG_COMMAND, Optional: true}},
+      Help: "list the commands or show how to use one"})
 
-          // leave a room
-          case "leave":
-            // leave the current room (we aren't allowing multiple rooms)
-            sendCommand("leave", "", conn)
+  for alias, commandLine := range properties.Aliases {
+    registry.Alias(alias, commandLine)
+  }
+  registry.SetCompleter(commands.ARG_USER, rosterUsers)
+  registry.SetCompleter(commands.ARG_ROOM, rosterRooms)
+}
 
-          // disconnect from the chat server
-          case "disconnect":
-            sendCommand("disconnect", "", conn)
+// add the commands published by the server that we don't have ourselves
+// they are sent to the server as they are and documented with the server's description
+func registerServerCommands(catalog []util.CommandInfo) {
+  kinds := map[string]int{"user": commands.ARG_USER, "room": commands.ARG_ROOM}
+  for _, info := range catalog {
+    if _, ok := registry.Find(info.Name); ok || info.Name == "" || strings.ContainsAny(info.Name, " /") {
+      continue
+    }
+    args := []commands.Arg{}
+    for _, arg := range info.Args {
+      args = append(args, commands.Arg{Name: arg.Name, Kind: kinds[arg.Kind], Optional: arg.Optional, Rest: arg.Rest})
+    }
+    name := info.Name
+    registry.Register(commands.Command{Name: name, Args: args, Help: info.Description,
+        Run: func(body string) {
+          sendCommand(name, body, currentConnection())
+        }})
+  }
+}
 
-          default:
-            fmt.Printf("Unknown command \"%s\"\n", command.Command)
-        }
-      }
+// list the commands ("/help") or show the details of one ("/help {command}")
+func showHelp(body string) {
+  name := strings.TrimPrefix(strings.TrimSpace(body), "/")
+  if (name == "") {
+    for _, command := range registry.Commands() {
+      output(messages.Render("help", i18n.Data{Body: command.Usage(), Detail: command.Help}))
     }
+    return
+  }
+
+  command, ok := registry.Find(name)
+  if (!ok) {
+    output(messages.Render("unknown-command", i18n.Data{Body: name}))
+    return
+  }
+  output(messages.Render("help", i18n.Data{Body: command.Usage(), Detail: command.Help}))
+  aliases := append(append([]string{}, command.Aliases...), registry.UserAliases(command.Name)...)
+  if (len(aliases) > 0) {
+    output(messages.Render("help-aliases", i18n.Data{Body: "/" + strings.Join(aliases, ", /"), Count: len(aliases)}))
   }
 }
 
 // listen for any commands that come from the chat server
 // like someone entered the room, said something, or left the room
-func watchForConnectionInput(username string, properties util.Properties, conn net.Conn) {
+// this returns when the connection is lost (joined is true if we got through the handshake)
+func watchForConnectionInput(username string, conn net.Conn) (joined bool, err error) {
   reader := bufio.NewReader(conn)
 
   for true {
     message, err := reader.ReadString('\n')
-    util.CheckForError(err, "Lost server connection");
+    if (err != nil) {
+      return joined, err
+    }
     message = strings.TrimSpace(message)
     if (message != "") {
       Command := parseCommand(message)
       switch Command.Command {
 
-        // the handshake - send out our username
+        // the handshake - send out our protocol version and then resume our session or send our username
         case "ready":
-          sendCommand("user", username, conn)
+          sendCommand("protocol", strconv.Itoa(util.PROTOCOL_VERSION), conn)
+          if (sessionToken != "") {
+            sendCommand("resume", sessionToken, conn)
+          } else {
+            join(username, conn)
+          }
+          if (screen != nil) {
+            // fill in the sidebar
+            setRoster("", "")
+            sendCommand("who", "", conn)
+          }
+
+        // the server has given us a session we can resume if we lose the connection
+        case "session":
+          sessionToken = Command.Body
+          joined = true
+          setConnectedStatus(username)
+
+        // we have reconnected and are back in our session (as if nothing happened)
+        case "resumed":
+          joined = true
+          currentRoom = Command.Body
+          if (currentRoom == LOBBY) {
+            currentRoom = ""
+          }
+          setConnectedStatus(username)
+          show(Command, "resumed", i18n.Data{User: Command.Username})
+
+        // heartbeat - let the server know we are still here
+        case "ping":
+          sendCommand("pong", Command.Body, conn)
 
         // the user has connected to the chat server
         case "connect":
-          fmt.Printf(properties.HasEnteredTheLobbyMessage + "\n", Command.Username)
+          if (Command.Username == username) {
+            joined = true
+            setConnectedStatus(username)
+          }
+          setRoster(Command.Username, LOBBY)
+          updateSidebar()
+          show(Command, "connect", i18n.Data{User: Command.Username})
 
         // the user has disconnected
         case "disconnect":
-          fmt.Printf(properties.HasLeftTheLobbyMessage + "\n", Command.Username)
+          setRoster(Command.Username, "")
+          updateSidebar()
+          show(Command, "disconnect", i18n.Data{User: Command.Username})
 
         // the user has entered a room
         case "enter":
-          fmt.Printf(properties.HasEnteredTheRoomMessage + "\n", Command.Username, Command.Body)
+          if (Command.Username == username) {
+            currentRoom = Command.Body
+            setConnectedStatus(username)
+          }
+          setRoster(Command.Username, Command.Body)
+          updateSidebar()
+          show(Command, "enter", i18n.Data{User: Command.Username, Room: Command.Body})
 
         // the user has left a room
         case "leave":
-          fmt.Printf(properties.HasLeftTheRoomMessage + "\n", Command.Username, Command.Body)
+          if (Command.Username == username) {
+            currentRoom = ""
+            setConnectedStatus(username)
+          }
+          setRoster(Command.Username, LOBBY)
+          updateSidebar()
+          show(Command, "leave", i18n.Data{User: Command.Username, Room: Command.Body})
 
         // the user has sent a message
         case "message":
-          if (Command.Username != username) {
-            fmt.Printf(properties.ReceivedAMessage + "\n", Command.Username, Command.Body)
+          if (Command.Username != username || screen != nil) {
+            // our own messages are already on the console (unless we are using the terminal UI)
+            showMessage(Command, "message", i18n.Data{User: Command.Username, Body: Command.Body, ID: Command.ID}, username)
           }
 
-        // the user has connected to the chat server
+        // we are ignoring someone
         case "ignoring":
-          fmt.Printf(properties.IgnoringMessage + "\n", Command.Body)
+          if (!contains(ignoring, Command.Body)) {
+            ignoring = append(ignoring, Command.Body)
+          }
+          show(Command, "ignoring", i18n.Data{User: Command.Body})
+
+        // someone has replied to a message
+        case "reply":
+          parent, text := getTarget(Command.Body)
+          if (Command.Username != username || screen != nil) {
+            // our own messages are already on the console (unless we are using the terminal UI)
+            showMessage(Command, "reply", i18n.Data{User: Command.Username, Body: text, ID: Command.ID, Parent: parent}, username)
+          }
+
+        // someone has mentioned us ("@username") in a message ("{room} {message}")
+        // the message itself has already been shown (highlighted, with the bell) if we are in the same room
+        case "mention":
+          room, text := util.ParseMentionBody(Command.Body)
+          if (room != currentRoom && (room != LOBBY || currentRoom != "")) {
+            showMessage(Command, "mention", i18n.Data{User: Command.Username, Room: room, Body: text, ID: Command.ID}, username)
+          }
+
+        // the commands the server supports - any we don't know about are passed through as they are
+        case "commands":
+          catalog, err := util.ParseCommandCatalog(Command.Body)
+          if (err == nil) {
+            registerServerCommands(catalog)
+          }
+
+        // someone that is connected and the room they are in (an empty "/who" ends the list)
+        case "who":
+          if (Command.Username != "") {
+            setRoster(Command.Username, Command.Body)
+            if (screen == nil) {
+              show(Command, "who", i18n.Data{User: Command.Username, Room: Command.Body})
+            }
+          } else {
+            updateSidebar()
+          }
+
+        // someone has sent us (and only us) a message
+        case "direct":
+          show(Command, "direct", i18n.Data{User: Command.Username, Body: Command.Body, ID: Command.ID})
+
+        // the user we sent a message to is offline so it will be delivered later
+        case "queued":
+          show(Command, "queued", i18n.Data{User: Command.Username})
+
+        // a message that was left for us while we were offline
+        case "inbox":
+          if (Command.Username == "") {
+            show(Command, "inbox-empty", i18n.Data{})
+          } else {
+            show(Command, "inbox", i18n.Data{User: Command.Username, Body: Command.Body, ID: Command.ID})
+          }
+
+        // our mailbox has been emptied
+        case "inbox-cleared":
+          show(Command, "inbox-cleared", i18n.Data{})
+
+        // a message has been changed, removed or reacted to
+        case "edit", "delete", "react":
+          target, text := getTarget(Command.Body)
+          show(Command, Command.Command, i18n.Data{User: Command.Username, Body: text, ID: target})
+
+        // our role password was accepted
+        case "authenticated":
+          show(Command, "authenticated", i18n.Data{Body: Command.Body})
+
+        // a moderator has disconnected, banned or unbanned someone
+        case "kick", "ban", "unban":
+          if (Command.Body == username && Command.Command != "unban") {
+            // it was us so we shouldn't come back
+            quit()
+          }
+          show(Command, Command.Command, i18n.Data{User: Command.Username, Body: Command.Body})
+
+        // a moderator has silenced someone ("{username} {duration}")
+        case "mute":
+          target, duration := splitFirst(Command.Body)
+          show(Command, "mute", i18n.Data{User: Command.Username, Body: target, Detail: duration})
+
+        // we aren't allowed on the server (it will disconnect us)
+        case "banned":
+          quit()
+          show(Command, "banned", i18n.Data{})
+
+        // the server couldn't do what we asked
+        case "error":
+          code, detail := splitFirst(Command.Body)
+          if (code == "session-expired") {
+            // the server doesn't remember us (it may have restarted) so join again
+            sessionToken = ""
+            join(username, conn)
+            break
+          } else if (code == "flooding") {
+            quit()
+          }
+          id, _ := getTarget(detail)
+          data := i18n.Data{Body: detail, ID: id}
+          if (code == "muted") {
+            // we are muted until the provided unix time
+            data.Time = time.Unix(id, 0)
+          }
+          show(Command, "error-" + code, data)
+
+        // a previous message from the room history or search results
+        case "history", "search":
+          if (Command.Username == "") {
+            show(Command, "no-messages", i18n.Data{})
+          } else {
+            showMessage(Command, "message", i18n.Data{User: Command.Username, Body: Command.Body, ID: Command.ID}, username)
+          }
       }
     }
   }
+  return joined, nil
+}
+
+// send our username and then go back to the room we were in and ignore the same people
+func join(username string, conn net.Conn) {
+  sendCommand("user", username, conn)
+  if (currentRoom != "") {
+    sendCommand("enter", currentRoom, conn)
+  }
+  for _, value := range ignoring {
+    sendCommand("ignore", value, conn)
+  }
+}
+
+// return true if the value is in the list
+func contains(values []string, value string) bool {
+  for _, v := range values {
+    if (v == value) {
+      return true
+    }
+  }
+  return false
+}
+
+// display a chat event (with the time it happened if we are showing timestamps)
+func show(command Command, key string, data i18n.Data) {
+  output(format(command, key, data))
+}
+
+// display a chat message - it is highlighted (and the bell is rung) if it mentions us
+func showMessage(command Command, key string, data i18n.Data, username string) {
+  if (key != "mention" && !util.IsMentioned(data.Body, username)) {
+    show(command, key, data)
+    return
+  }
+  output(HIGHLIGHT_START + format(command, key, data) + HIGHLIGHT_END)
+  ring()
+}
+
+// ring the terminal bell (if MentionBell is set)
+func ring() {
+  if (mentionBell && screen != nil) {
+    screen.Bell()
+  } else if (mentionBell) {
+    fmt.Print("\a")
+  }
+}
+
+// show a line in the scrollback pane (or the console if we aren't using the terminal UI)
+func output(line string) {
+  if (screen != nil) {
+    screen.Print(line)
+  } else {
+    fmt.Println(line)
+  }
+}
+
+// show our connection state and current room in the status bar
+func setStatus(key string, data i18n.Data) {
+  if (screen != nil) {
+    screen.SetStatus(messages.Render(key, data))
+  }
+}
+
+// show the status for a connected user
+func setConnectedStatus(username string) {
+  room := currentRoom
+  if (room == "") {
+    room = LOBBY
+  }
+  setStatus("status-connected", i18n.Data{User: username, Room: room})
+}
+
+// set the room a user is in (an empty room removes the user and an empty username clears everyone)
+func setRoster(username string, room string) {
+  rosterLock.Lock()
+  defer rosterLock.Unlock()
+  if (username == "") {
+    roster = map[string]string{}
+  } else if (room == "") {
+    delete(roster, username)
+  } else {
+    roster[username] = room
+  }
+}
+
+// return the connected users (for tab completion)
+func rosterUsers() []string {
+  rosterLock.Lock()
+  defer rosterLock.Unlock()
+  rtn := []string{}
+  for username := range roster {
+    rtn = append(rtn, username)
+  }
+  return rtn
+}
+
+// return the rooms that have users in them (for tab completion)
+func rosterRooms() []string {
+  rosterLock.Lock()
+  defer rosterLock.Unlock()
+  rtn := []string{}
+  for _, room := range roster {
+    if (!contains(rtn, room)) {
+      rtn = append(rtn, room)
+    }
+  }
+  return rtn
+}
+
+// show the rooms (with the number of users in them) and the users in our room in the sidebar
+func updateSidebar() {
+  if (screen == nil) {
+    return
+  }
+  room := currentRoom
+  if (room == "") {
+    room = LOBBY
+  }
+  counts := map[string]int{room: 0}
+  members := []string{}
+  rosterLock.Lock()
+  for username, userRoom := range roster {
+    counts[userRoom]++
+    if (userRoom == room) {
+      members = append(members, username)
+    }
+  }
+  rosterLock.Unlock()
+  rooms := []string{}
+  for name := range counts {
+    rooms = append(rooms, name)
+  }
+  sort.Strings(rooms)
+  sort.Strings(members)
+
+  lines := []string{messages.Render("sidebar-rooms", i18n.Data{})}
+  for _, name := range rooms {
+    marker := "  "
+    if (name == room) {
+      marker = "* "
+    }
+    lines = append(lines, marker + name + " (" + strconv.Itoa(counts[name]) + ")")
+  }
+  lines = append(lines, "", messages.Render("sidebar-members", i18n.Data{Count: len(members)}))
+  for _, username := range members {
+    lines = append(lines, "  " + username)
+  }
+  screen.SetSidebar(lines)
+}
+
+// render a chat event (with the time it happened if we are showing timestamps)
+func format(command Command, key string, data i18n.Data) string {
+  if (data.Time.IsZero()) {
+    data.Time = command.Time
+  }
+  line := messages.Render(key, data)
+  if (timestampFormat != "") {
+    line = command.Time.Local().Format(timestampFormat) + " " + line
+  }
+  return line
 }
 
 // send a command to the chat server
@@ -172,16 +743,40 @@ func parseInput(message string) Command {
   }
 }
 
+// split "{first} {rest}" content (like "{message id} {text}") into the message id and remaining text
+func getTarget(body string) (int64, string) {
+  first, rest := splitFirst(body)
+  id, _ := strconv.ParseInt(first, 10, 64)
+  return id, rest
+}
+
+// split content into the first word and the rest of the content
+func splitFirst(body string) (string, string) {
+  parts := strings.SplitN(strings.TrimSpace(body), " ", 2)
+  if (len(parts) == 1) {
+    return parts[0], ""
+  }
+  return parts[0], strings.TrimSpace(parts[1])
+}
+
 // look for "/Command [name] body contents" where [name] is optional
 func parseCommand(message string) Command {
   res := chatServerResponseRegex.FindAllStringSubmatch(message, -1)
   if (len(res) == 1) {
     // we've got a match
-    return Command {
-      Command: util.Decode(res[0][1]),
-      Username: util.Decode(res[0][2]),
-      Body: util.Decode(res[0][3]),
+    rtn := Command {
+      Command: tui.Sanitize(util.Decode(res[0][1])),
+      Username: tui.Sanitize(util.Decode(res[0][2])),
+      Body: tui.Sanitize(util.Decode(res[0][5])),
+      Time: time.Now(),
+    }
+    if (res[0][3] != "") {
+      // the server has provided the action id and time
+      rtn.ID, _ = strconv.ParseInt(res[0][3], 10, 64)
+      seconds, _ := strconv.ParseInt(res[0][4], 10, 64)
+      rtn.Time = time.Unix(seconds, 0)
     }
+    return rtn
   } else {
     // it's irritating that I can't return a nil value here - must be something I'm missing
     return Command{}
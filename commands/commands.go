@@ -0,0 +1,254 @@
+// Registry of the client's console commands
+// Each command declares its name, aliases, arguments and help text which are used to run it, show "/help"
+// and complete it (and its arguments) with tab in the terminal UI
+package commands
+
+import (
+  "fmt"
+  "sort"
+  "strings"
+  "sync"
+)
+
+// kinds of command arguments (used for tab completion)
+const (
+  // free text (not completed)
+  ARG_TEXT = iota
+  // a connected user
+  ARG_USER
+  // a room
+  ARG_ROOM
+  // a command name
+  ARG_COMMAND
+)
+
+// an argument a command takes
+type Arg struct {
+  Name string
+  Kind int
+  // true if the argument can be left out
+  Optional bool
+  // the values the argument can have (completed with tab)
+  Choices []string
+  // true if the argument takes the rest of the line
+  Rest bool
+}
+
+// a console command
+type Command struct {
+  Name string
+  Aliases []string
+  Args []Arg
+  Help string
+  // called with everything after the command name
+  Run func(body string)
+}
+
+// the registered commands and user defined aliases
+type Registry struct {
+  lock sync.RWMutex
+  // name or alias -> command
+  commands map[string]*Command
+  // user defined alias -> command line it stands for (like "j" -> "enter" or "brb" -> "message be right back")
+  aliases map[string]string
+  // argument kind -> the current values (for tab completion)
+  completers map[int]func() []string
+}
+
+// create an empty registry
+func New() *Registry {
+  return &Registry{
+    commands: map[string]*Command{},
+    aliases: map[string]string{},
+    completers: map[int]func() []string{},
+  }
+}
+
+// add a command (replacing any command with the same name or alias)
+func (registry *Registry) Register(command Command) {
+  registry.lock.Lock()
+  defer registry.lock.Unlock()
+
+  registry.commands[command.Name] = &command
+  for _, alias := range command.Aliases {
+    registry.commands[alias] = &command
+  }
+}
+
+// add a user defined alias for a command line (the alias is replaced by the command line when it is used)
+func (registry *Registry) Alias(alias string, commandLine string) {
+  registry.lock.Lock()
+  defer registry.lock.Unlock()
+  registry.aliases[alias] = strings.TrimPrefix(strings.TrimSpace(commandLine), "/")
+}
+
+// set where the values for an argument kind come from (like the connected users for ARG_USER)
+func (registry *Registry) SetCompleter(kind int, values func() []string) {
+  registry.lock.Lock()
+  defer registry.lock.Unlock()
+  registry.completers[kind] = values
+}
+
+// return the command with the name or alias
+func (registry *Registry) Find(name string) (*Command, bool) {
+  registry.lock.RLock()
+  defer registry.lock.RUnlock()
+  command, ok := registry.commands[name]
+  return command, ok
+}
+
+// return the registered commands (sorted by name)
+func (registry *Registry) Commands() []*Command {
+  registry.lock.RLock()
+  defer registry.lock.RUnlock()
+
+  rtn := []*Command{}
+  for name, command := range registry.commands {
+    if (name == command.Name) {
+      rtn = append(rtn, command)
+    }
+  }
+  sort.Slice(rtn, func(i, j int) bool {
+    return rtn[i].Name < rtn[j].Name
+  })
+  return rtn
+}
+
+// return the user defined aliases for the command
+func (registry *Registry) UserAliases(name string) []string {
+  registry.lock.RLock()
+  defer registry.lock.RUnlock()
+
+  rtn := []string{}
+  for alias, commandLine := range registry.aliases {
+    if (strings.Fields(commandLine + " ")[0] == name) {
+      rtn = append(rtn, alias)
+    }
+  }
+  sort.Strings(rtn)
+  return rtn
+}
+
+// run a command (the name can be an alias) - false is returned if there isn't a command with the name
+func (registry *Registry) Run(name string, body string) bool {
+  registry.lock.RLock()
+  if commandLine, ok := registry.aliases[name]; ok {
+    // user defined aliases are expanded once
+    parts := strings.SplitN(commandLine, " ", 2)
+    name = parts[0]
+    if (len(parts) > 1) {
+      body = strings.TrimSpace(parts[1] + " " + body)
+    }
+  }
+  command, ok := registry.commands[name]
+  registry.lock.RUnlock()
+
+  if (ok) {
+    command.Run(body)
+  }
+  return ok
+}
+
+// describe how the command is used ("/enter {room}", "/history [count]")
+func (command *Command) Usage() string {
+  rtn := "/" + command.Name
+  for _, arg := range command.Args {
+    name := arg.Name
+    if (len(arg.Choices) > 0) {
+      name = strings.Join(arg.Choices, "|")
+    }
+    if (arg.Optional) {
+      rtn += fmt.Sprintf(" [%s]", name)
+    } else {
+      rtn += fmt.Sprintf(" {%s}", name)
+    }
+  }
+  return rtn
+}
+
+// complete the last word of the input line
+// command names (and aliases) are completed after "/", arguments are completed by their kind and "@" completes users
+// the possible lines are returned (sorted)
+func (registry *Registry) Complete(line string) []string {
+  registry.lock.RLock()
+  defer registry.lock.RUnlock()
+
+  words := strings.Split(line, " ")
+  last := words[len(words) - 1]
+  prefix := strings.Join(words[:len(words) - 1], " ")
+  if (prefix != "") {
+    prefix += " "
+  }
+
+  candidates := []string{}
+  if (len(words) == 1 && strings.HasPrefix(last, "/")) {
+    for name := range registry.commands {
+      candidates = append(candidates, "/" + name + " ")
+    }
+    for alias := range registry.aliases {
+      candidates = append(candidates, "/" + alias + " ")
+    }
+  } else if (strings.HasPrefix(last, "@")) {
+    for _, username := range registry.values(ARG_USER) {
+      candidates = append(candidates, "@" + username + " ")
+    }
+  } else if (strings.HasPrefix(line, "/")) {
+    for _, value := range registry.argValues(strings.TrimPrefix(words[0], "/"), len(words) - 2) {
+      candidates = append(candidates, value + " ")
+    }
+  }
+
+  rtn := []string{}
+  for _, candidate := range candidates {
+    if (strings.HasPrefix(candidate, last) && !contains(rtn, prefix + candidate)) {
+      rtn = append(rtn, prefix + candidate)
+    }
+  }
+  sort.Strings(rtn)
+  return rtn
+}
+
+// return the possible values for a command's argument (registry.lock must be held)
+func (registry *Registry) argValues(name string, index int) []string {
+  command, ok := registry.commands[name]
+  if (!ok || index < 0 || len(command.Args) == 0) {
+    return []string{}
+  }
+  if (index >= len(command.Args)) {
+    if (!command.Args[len(command.Args) - 1].Rest) {
+      return []string{}
+    }
+    index = len(command.Args) - 1
+  }
+
+  arg := command.Args[index]
+  if (len(arg.Choices) > 0) {
+    return arg.Choices
+  }
+  if (arg.Kind == ARG_COMMAND) {
+    rtn := []string{}
+    for name := range registry.commands {
+      rtn = append(rtn, name)
+    }
+    return rtn
+  }
+  return registry.values(arg.Kind)
+}
+
+// return the current values for an argument kind (registry.lock must be held)
+func (registry *Registry) values(kind int) []string {
+  if completer, ok := registry.completers[kind]; ok {
+    return completer()
+  }
+  return []string{}
+}
+
+// return true if the value is in the list
+func contains(values []string, value string) bool {
+  for _, v := range values {
+    if (v == value) {
+      return true
+    }
+  }
+  return false
+}
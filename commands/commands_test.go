@@ -0,0 +1,109 @@
+package commands
+
+import (
+  "strings"
+  "testing"
+)
+
+// a registry with a few commands that record what they were run with
+func testRegistry(ran *[]string) *Registry {
+  registry := New()
+  record := func(name string) func(string) {
+    return func(body string) {
+      *ran = append(*ran, strings.TrimSpace(name + " " + body))
+    }
+  }
+  registry.Register(Command{Name: "enter", Aliases: []string{"join"}, Args: []Arg{{Name: "room", Kind: ARG_ROOM}},
+      Run: record("enter")})
+  registry.Register(Command{Name: "message", Args: []Arg{{Name: "message", Rest: true}}, Run: record("message")})
+  registry.Register(Command{Name: "ignore", Args: []Arg{{Name: "username", Kind: ARG_USER}}, Run: record("ignore")})
+  registry.Register(Command{Name: "history", Args: []Arg{{Name: "count", Optional: true}}, Run: record("history")})
+  registry.Register(Command{Name: "help", Args: []Arg{{Name: "command", Kind: ARG_COMMAND, Optional: true}},
+      Run: record("help")})
+  registry.Register(Command{Name: "theme", Args: []Arg{{Name: "theme", Choices: []string{"dark", "light"}}},
+      Run: record("theme")})
+  registry.Alias("brb", "/message be right back")
+  registry.SetCompleter(ARG_USER, func() []string {
+    return []string{"ann", "bob", "al"}
+  })
+  registry.SetCompleter(ARG_ROOM, func() []string {
+    return []string{"lobby", "ops"}
+  })
+  return registry
+}
+
+func TestRun(t *testing.T) {
+  tests := []struct {
+    name string
+    body string
+    expected string
+  }{
+    {"enter", "ops", "enter ops"},
+    {"join", "ops", "enter ops"},
+    {"brb", "", "message be right back"},
+    {"brb", "soon", "message be right back soon"},
+    {"unknown", "", ""},
+  }
+  for _, test := range tests {
+    ran := []string{}
+    found := testRegistry(&ran).Run(test.name, test.body)
+    if (found != (test.expected != "")) {
+      t.Errorf("/%s: expected found to be %v", test.name, test.expected != "")
+    }
+    if (strings.Join(ran, "|") != test.expected) {
+      t.Errorf("/%s %s: expected %q but ran %q", test.name, test.body, test.expected, ran)
+    }
+  }
+}
+
+func TestComplete(t *testing.T) {
+  tests := []struct {
+    line string
+    expected []string
+  }{
+    {"/h", []string{"/help ", "/history "}},
+    {"/j", []string{"/join "}},
+    {"/b", []string{"/brb "}},
+    {"/enter o", []string{"/enter ops "}},
+    {"/ignore a", []string{"/ignore al ", "/ignore ann "}},
+    {"/theme ", []string{"/theme dark ", "/theme light "}},
+    {"/help th", []string{"/help theme "}},
+    // only the declared arguments are completed
+    {"/ignore ann a", []string{}},
+    {"/message hi @b", []string{"/message hi @bob "}},
+    {"hello @a", []string{"hello @al ", "hello @ann "}},
+    {"hello a", []string{}},
+  }
+  for _, test := range tests {
+    actual := testRegistry(&[]string{}).Complete(test.line)
+    if (strings.Join(actual, "|") != strings.Join(test.expected, "|")) {
+      t.Errorf("%q: expected %q but got %q", test.line, test.expected, actual)
+    }
+  }
+}
+
+func TestHelp(t *testing.T) {
+  registry := testRegistry(&[]string{})
+  usages := map[string]string{
+    "enter": "/enter {room}",
+    "history": "/history [count]",
+    "theme": "/theme {dark|light}",
+  }
+  for name, expected := range usages {
+    command, ok := registry.Find(name)
+    if (!ok || command.Usage() != expected) {
+      t.Errorf("expected the usage of %s to be %q", name, expected)
+    }
+  }
+
+  names := []string{}
+  for _, command := range registry.Commands() {
+    names = append(names, command.Name)
+  }
+  if (strings.Join(names, ",") != "enter,help,history,ignore,message,theme") {
+    t.Errorf("expected each command once (sorted) but got %v", names)
+  }
+  if aliases := registry.UserAliases("message"); len(aliases) != 1 || aliases[0] != "brb" {
+    t.Errorf("expected the brb alias for message but got %v", aliases)
+  }
+}
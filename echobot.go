@@ -0,0 +1,61 @@
+// Example chat bot (see ./bot) which repeats what it is asked to
+// To run the bot, use "go run echobot.go {username} [room...]" (it stays in the lobby if no rooms are given)
+// > !echo hello         -> hello
+// > !count              -> the number of messages the bot has heard in the room
+// > echobot are you there? -> yes
+package main
+
+import (
+  "flag"
+  "fmt"
+  "os"
+  "regexp"
+  "strings"
+  "time"
+  "./util"
+  "./bot"
+)
+
+func main() {
+  util.ParseFlags()
+  if (flag.NArg() < 1) {
+    println("You must provide the bot's username as the first parameter ")
+    os.Exit(1)
+  }
+  echo := bot.New(flag.Arg(0), util.LoadConfig())
+  rooms := flag.Args()[1:]
+  if (len(rooms) == 0) {
+    rooms = []string{bot.LOBBY}
+  }
+  echo.Join(rooms...)
+
+  echo.Command("echo", "repeat the rest of the message", func(ctx *bot.Context) {
+    ctx.Reply(strings.Join(ctx.Args, " "))
+  })
+
+  echo.Command("count", "show how many messages have been said in this room", func(ctx *bot.Context) {
+    value, _ := ctx.State().Get("count")
+    count, _ := value.(int)
+    ctx.Reply(fmt.Sprintf("%v messages so far", count))
+  })
+
+  // count everything said in each room
+  echo.Trigger(``, func(ctx *bot.Context) {
+    ctx.State().Update(func(values map[string]interface{}) {
+      count, _ := values["count"].(int)
+      values["count"] = count + 1
+    })
+  })
+
+  echo.Trigger(`(?i)` + regexp.QuoteMeta(echo.Username) + `.*\?$`, func(ctx *bot.Context) {
+    ctx.Reply("yes")
+  })
+
+  for _, room := range rooms {
+    echo.Every(room, time.Hour, func(ctx *bot.Context) {
+      ctx.Reply("still here (say !help to see what I can do)")
+    })
+  }
+
+  util.CheckForError(echo.Run(), "Lost server connection")
+}
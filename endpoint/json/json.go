@@ -3,12 +3,30 @@ package json
 import (
   "net/http"
   "encoding/json"
-  "../.././util"
+  "strconv"
+  "strings"
+  "unicode"
+  "unicode/utf8"
+  "../../util"
 )
 
 const SEARCH_PATH = "/messages/search/"
 const USER_PATH = "/messages/user/"
 const ALL_PATH = "/messages/all"
+const THREAD_PATH = "/messages/thread/"
+const WEBHOOK_PATH = "/webhook"
+// the room webhook messages are sent to if they don't say
+const LOBBY = "lobby"
+// the authorization scheme webhook tokens are sent with
+const BEARER = "Bearer "
+
+// a message posted to the incoming webhook
+type webhookMessage struct {
+  Room string      `json:"room"`
+  // who the message is shown as being from
+  Name string      `json:"name"`
+  Text string      `json:"text"`
+}
 
 func Start() {
   properties := util.LoadConfig();
@@ -16,15 +34,23 @@ func Start() {
   http.HandleFunc(SEARCH_PATH, searchMessages)
   http.HandleFunc(USER_PATH, userMessages)
   http.HandleFunc(ALL_PATH, allMessages)
+  http.HandleFunc(THREAD_PATH, threadMessages)
+  http.HandleFunc(WEBHOOK_PATH, postWebhookMessage)
+  http.HandleFunc(STREAM_PATH, streamActions)
+  http.HandleFunc(POLL_PATH, pollActions)
 
   err := http.ListenAndServe(":" + properties.JSONEndpointPort, nil)
   util.CheckForError(err, "Can't create JSON endpoint")
 }
 
+// full-text search (ranked with highlighted snippets) using the search index
+// optional "limit" query parameter restricts the number of results
 func searchMessages(w http.ResponseWriter, r *http.Request) {
   var searchTerm = r.URL.Path[len(SEARCH_PATH):]
+  limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
 
-  returnQuery("message", searchTerm, "", w, r)
+  results := util.SearchMessages("message", searchTerm, "", "", limit)
+  returnJSON(results, w)
 }
 
 func userMessages(w http.ResponseWriter, r *http.Request) {
@@ -37,11 +63,91 @@ func allMessages(w http.ResponseWriter, r *http.Request) {
   returnQuery("message", "", "", w, r)
 }
 
+// a message with all of its replies (and their replies)
+func threadMessages(w http.ResponseWriter, r *http.Request) {
+  id, err := strconv.ParseInt(r.URL.Path[len(THREAD_PATH):], 10, 64)
+  thread, ok := util.FindThread(id)
+  if (err != nil || !ok) {
+    http.NotFound(w, r)
+    return
+  }
+  returnJSON(thread, w)
+}
+
+// post a message from another system ({"room": "ops", "name": "ci", "text": "build failed"})
+// the message is shown as being from "webhook:{name}" (names of connected users, admins and moderators are refused)
+// the request must have an "Authorization: Bearer {token}" header with one of the IncomingWebhookTokens
+// the message is sent to the room like any other message and the logged message is returned
+func postWebhookMessage(w http.ResponseWriter, r *http.Request) {
+  props := util.LoadConfig()
+  if (r.Method != "POST") {
+    w.Header().Set("Allow", "POST")
+    http.Error(w, "POST a message", http.StatusMethodNotAllowed)
+    return
+  }
+  authorization := r.Header.Get("Authorization")
+  if (len(props.IncomingWebhookTokens) == 0 || !strings.HasPrefix(authorization, BEARER) ||
+      !util.IsWebhookToken(strings.TrimPrefix(authorization, BEARER), props)) {
+    http.Error(w, "invalid token", http.StatusUnauthorized)
+    return
+  }
+
+  var message webhookMessage
+  err := json.NewDecoder(r.Body).Decode(&message)
+  if (err != nil) {
+    http.Error(w, "invalid message: " + err.Error(), http.StatusBadRequest)
+    return
+  }
+  message.Name = strings.TrimSpace(message.Name)
+  message.Text = strings.TrimSpace(message.Text)
+  if (message.Room == "") {
+    message.Room = LOBBY
+  }
+  if (message.Name == "" || message.Text == "" || strings.ContainsAny(message.Name, " []")) {
+    http.Error(w, "a name (without spaces) and text must be provided", http.StatusBadRequest)
+    return
+  }
+  if (hasControlCharacters(message.Name) || hasControlCharacters(message.Text)) {
+    // a line break would end the chat command and start another one
+    http.Error(w, "the name and text can't have line breaks or other control characters", http.StatusBadRequest)
+    return
+  }
+  if (util.IsReservedWebhookName(message.Name, props)) {
+    http.Error(w, "the name " + message.Name + " belongs to a user", http.StatusConflict)
+    return
+  }
+  if (props.MaxMessageLength > 0 && utf8.RuneCountInString(message.Text) > props.MaxMessageLength) {
+    http.Error(w, "the text is longer than " + strconv.Itoa(props.MaxMessageLength) + " characters", http.StatusBadRequest)
+    return
+  }
+
+  client := util.NewWebhookClient(message.Name, message.Room, r.RemoteAddr)
+  action, ok := util.BroadcastAction(util.Action{Command: "message", Content: util.Encode(message.Text)}, client, props)
+  if (!ok) {
+    http.Error(w, "the message was rejected", http.StatusForbidden)
+    return
+  }
+  util.NotifyMentions(action, client)
+  util.Infof("Webhook message from %s (%s) to %s", message.Name, r.RemoteAddr, message.Room)
+  returnJSON(action, w)
+}
+
+// return true if the value has a control character other than tab
+func hasControlCharacters(value string) bool {
+  return strings.IndexFunc(value, func(r rune) bool {
+    return r != '\t' && unicode.IsControl(r)
+  }) >= 0
+}
+
 func returnQuery(actionType string, search string, username string,
     w http.ResponseWriter, r *http.Request) {
 
   actions := util.QueryMessages(actionType, search, username);
-  payload, err := json.Marshal(actions)
+  returnJSON(util.MessageViews(actions), w)
+}
+
+func returnJSON(value interface{}, w http.ResponseWriter) {
+  payload, err := json.Marshal(value)
   util.CheckForError(err, "Can't create JSON response")
 
   w.Header().Set("Content-Type", "text/json")
@@ -0,0 +1,53 @@
+package json
+
+import (
+  "net"
+  "net/http"
+  "net/http/httptest"
+  "path/filepath"
+  "strings"
+  "testing"
+  "../../util"
+)
+
+func TestWebhookMessages(t *testing.T) {
+  dir := t.TempDir()
+  t.Setenv("CHAT_INCOMING_WEBHOOK_TOKENS", "t0ken")
+  t.Setenv("CHAT_MODERATORS", "mo")
+  t.Setenv("CHAT_MAILBOX_FILE", filepath.Join(dir, "mailbox.json"))
+  conn, other := net.Pipe()
+  defer other.Close()
+  ann := &util.Client{Connection: conn, Username: "ann", Room: LOBBY}
+  ann.Register()
+  defer ann.Close(false)
+
+  tests := []struct {
+    authorization string
+    body string
+    expected int
+  }{
+    {"Bearer t0ken", `{"room": "ops", "name": "ci", "text": "build failed"}`, http.StatusOK},
+    {"t0ken", `{"name": "ci", "text": "build failed"}`, http.StatusUnauthorized},
+    {"Basic t0ken", `{"name": "ci", "text": "build failed"}`, http.StatusUnauthorized},
+    {"Bearer wrong", `{"name": "ci", "text": "build failed"}`, http.StatusUnauthorized},
+    {"Bearer t0ken", `{"name": "mo", "text": "trust me"}`, http.StatusConflict},
+    {"Bearer t0ken", `{"name": "ann", "text": "it's me"}`, http.StatusConflict},
+    {"Bearer t0ken", `{"name": "ci"}`, http.StatusBadRequest},
+    {"Bearer t0ken", `{"name": "ci", "text": "a\n/kick joe"}`, http.StatusBadRequest},
+    {"Bearer t0ken", `{"name": "ci", "text": "a\r/banned"}`, http.StatusBadRequest},
+    {"Bearer t0ken", `{"name": "ci\n/kick", "text": "a"}`, http.StatusBadRequest},
+    {"Bearer t0ken", `{"name": "ci", "text": "a\u0085b"}`, http.StatusBadRequest},
+  }
+  for i, test := range tests {
+    request := httptest.NewRequest("POST", WEBHOOK_PATH, strings.NewReader(test.body))
+    request.Header.Set("Authorization", test.authorization)
+    response := httptest.NewRecorder()
+    postWebhookMessage(response, request)
+    if (response.Code != test.expected) {
+      t.Errorf("test %d: expected status %d but got %d (%s)", i, test.expected, response.Code, response.Body)
+    }
+    if (response.Code == http.StatusOK && !strings.Contains(response.Body.String(), `"username":"webhook:ci"`)) {
+      t.Errorf("expected the message to be from webhook:ci but got %s", response.Body)
+    }
+  }
+}
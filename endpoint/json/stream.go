@@ -0,0 +1,166 @@
+package json
+
+import (
+  "net/http"
+  "encoding/json"
+  "fmt"
+  "strconv"
+  "strings"
+  "time"
+  "../../util"
+)
+
+const STREAM_PATH = "/stream"
+const POLL_PATH = "/stream/poll"
+// how often a comment is sent to keep idle event streams open
+const STREAM_KEEPALIVE = 15 * time.Second
+// how long (in seconds) a long-poll waits for new actions if it doesn't say
+const POLL_TIMEOUT = 30
+// the longest a long-poll can wait
+const MAX_POLL_TIMEOUT = 120
+
+// stream new actions as server-sent events ("id: {action id}", "event: {command}", "data: {action JSON}")
+// the actions can be filtered with the "room", "user" and "command" query parameters (comma separated or repeated)
+// a "Last-Event-ID" header (or "lastEventId" query parameter) first sends the actions after that id
+// (or every action if the id is newer than any we have - the ids have started again after a restart)
+func streamActions(w http.ResponseWriter, r *http.Request) {
+  flusher, ok := w.(http.Flusher)
+  if (!ok) {
+    http.Error(w, "streaming isn't supported", http.StatusInternalServerError)
+    return
+  }
+  filter := streamFilter(r)
+  lastID, resume := lastEventID(r)
+
+  // subscribe before looking at the earlier actions so nothing is missed in between
+  subscription := util.Subscribe(filter)
+  defer subscription.Close()
+
+  w.Header().Set("Content-Type", "text/event-stream")
+  w.Header().Set("Cache-Control", "no-cache")
+  w.Header().Set("Connection", "keep-alive")
+  w.WriteHeader(http.StatusOK)
+  if (resume) {
+    for _, action := range util.ActionsSince(lastID, filter) {
+      writeEvent(action, w)
+      lastID = action.ID
+    }
+  }
+  flusher.Flush()
+
+  keepalive := time.NewTicker(STREAM_KEEPALIVE)
+  defer keepalive.Stop()
+  for {
+    select {
+      case <-r.Context().Done():
+        return
+      case <-keepalive.C:
+        fmt.Fprint(w, ": keepalive\n\n")
+      case action, ok := <-subscription.Actions:
+        if (!ok) {
+          // we have fallen behind - the client will reconnect and resume from the last id
+          return
+        }
+        if (action.ID <= lastID) {
+          // already sent when resuming
+          continue
+        }
+        writeEvent(action, w)
+        lastID = action.ID
+    }
+    flusher.Flush()
+  }
+}
+
+// long-poll for new actions (for clients that can't use server-sent events)
+// the actions after the "since" id are returned as soon as there are any (or an empty list after "timeout" seconds)
+// a "since" id newer than the newest action returns every action (the ids have started again after a restart)
+// the same filters as the event stream can be used
+func pollActions(w http.ResponseWriter, r *http.Request) {
+  filter := streamFilter(r)
+  since, resume := lastEventID(r)
+  timeout, err := strconv.Atoi(r.URL.Query().Get("timeout"))
+  if (err != nil || timeout <= 0) {
+    timeout = POLL_TIMEOUT
+  } else if (timeout > MAX_POLL_TIMEOUT) {
+    timeout = MAX_POLL_TIMEOUT
+  }
+
+  subscription := util.Subscribe(filter)
+  defer subscription.Close()
+
+  rtn := []util.Action{}
+  if (resume) {
+    rtn = util.ActionsSince(since, filter)
+  }
+  if (len(rtn) == 0) {
+    timer := time.NewTimer(time.Duration(timeout) * time.Second)
+    defer timer.Stop()
+    select {
+      case <-r.Context().Done():
+        return
+      case <-timer.C:
+      case action, ok := <-subscription.Actions:
+        if (ok) {
+          rtn = append(rtn, action)
+        }
+    }
+    // include anything else that arrived at the same time
+    for len(subscription.Actions) > 0 {
+      rtn = append(rtn, <-subscription.Actions)
+    }
+  }
+  returnJSON(rtn, w)
+}
+
+// write an action as a server-sent event
+func writeEvent(action util.Action, w http.ResponseWriter) {
+  payload, err := json.Marshal(action)
+  util.CheckForError(err, "Can't create JSON response")
+  fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", action.ID, action.Command, payload)
+}
+
+// the filter from the "room", "user" and "command" query parameters
+func streamFilter(r *http.Request) util.ActionFilter {
+  query := r.URL.Query()
+  return util.ActionFilter{
+    Rooms: queryValues(query["room"]),
+    Users: queryValues(query["user"]),
+    Commands: queryValues(query["command"]),
+  }
+}
+
+// split comma separated (and repeated) query parameter values
+func queryValues(values []string) []string {
+  rtn := []string{}
+  for _, value := range values {
+    for _, item := range strings.Split(value, ",") {
+      if item = strings.TrimSpace(item); item != "" {
+        rtn = append(rtn, item)
+      }
+    }
+  }
+  return rtn
+}
+
+// return the action id to resume after ("Last-Event-ID" header or the "lastEventId" or "since" query parameter)
+// false is returned if there isn't one (only new actions are sent)
+// the action ids start again if the server is restarted without its log (the ids normally carry on from the log)
+// so an id newer than the newest action is from before the restart and 0 is returned to send everything
+func lastEventID(r *http.Request) (int64, bool) {
+  value := r.Header.Get("Last-Event-ID")
+  if (value == "") {
+    value = r.URL.Query().Get("lastEventId")
+  }
+  if (value == "") {
+    value = r.URL.Query().Get("since")
+  }
+  id, err := strconv.ParseInt(value, 10, 64)
+  if (err != nil || id < 0) {
+    return 0, false
+  }
+  if (id > util.LastActionID()) {
+    return 0, true
+  }
+  return id, true
+}
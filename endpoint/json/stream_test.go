@@ -0,0 +1,39 @@
+package json
+
+import (
+  "encoding/json"
+  "net/http/httptest"
+  "strconv"
+  "testing"
+  "../../util"
+)
+
+// return the actions a long-poll for the url returns
+func poll(t *testing.T, url string) []util.Action {
+  response := httptest.NewRecorder()
+  pollActions(response, httptest.NewRequest("GET", url, nil))
+  rtn := []util.Action{}
+  if err := json.Unmarshal(response.Body.Bytes(), &rtn); err != nil {
+    t.Fatalf("invalid response %s: %v", response.Body, err)
+  }
+  return rtn
+}
+
+func TestPollAfterRestart(t *testing.T) {
+  // a room nothing else has been said in
+  room := "restart" + strconv.FormatInt(util.LastActionID(), 10)
+  client := util.NewWebhookClient("ci", room, "192.0.2.1:1234")
+  first := util.LogClientAction(util.Action{Command: "message", Content: "first"}, client, util.LoadConfig())
+  second := util.LogClientAction(util.Action{Command: "message", Content: "second"}, client, util.LoadConfig())
+
+  actions := poll(t, POLL_PATH + "?room=" + room + "&since=" + strconv.FormatInt(first.ID, 10))
+  if (len(actions) != 1 || actions[0].ID != second.ID) {
+    t.Errorf("expected only the second action but got %v", actions)
+  }
+
+  // an id from before the server restarted (newer than anything we have)
+  actions = poll(t, POLL_PATH + "?room=" + room + "&since=" + strconv.FormatInt(second.ID + 100, 10))
+  if (len(actions) != 2 || actions[0].ID != first.ID || actions[1].ID != second.ID) {
+    t.Errorf("expected every action but got %v", actions)
+  }
+}
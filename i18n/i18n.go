@@ -0,0 +1,234 @@
+// Client side rendering of chat events using text/template message catalogs
+// English messages are built in and other locales are loaded from "{LocaleDir}/{locale}.json"
+// (a JSON object of message name -> template) where any missing message falls back to English
+package i18n
+
+import (
+  "encoding/json"
+  "fmt"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strings"
+  "text/template"
+  "time"
+)
+
+// locale used when none is provided
+const DEFAULT_LOCALE = "en"
+
+// the built in (English) messages
+var DEFAULT_MESSAGES = map[string]string{
+  // someone has entered a private room
+  "enter": `[{{.User}}] has entered the room "{{.Room}}"`,
+  // someone has left a private room
+  "leave": `[{{.User}}] has left the room "{{.Room}}"`,
+  // someone has connected
+  "connect": `[{{.User}}] has entered the lobby`,
+  // someone has disconnected
+  "disconnect": `[{{.User}}] has left the lobby`,
+  // someone has sent a chat
+  "message": `[{{.User}}] says: {{.Body}}{{if .ID}} (#{{.ID}}){{end}}`,
+  // someone has replied to a message
+  "reply": `[{{.User}}] replied to #{{.Parent}}: {{.Body}} (#{{.ID}})`,
+  // someone has reacted to a message
+  "react": `[{{.User}}] reacted {{.Body}} to #{{.ID}}`,
+  // the reaction is empty, too long or more than one word
+  "error-invalid-reaction": `That reaction can't be used`,
+  // someone has changed one of their messages
+  "edit": `[{{.User}}] edited #{{.ID}}: {{.Body}}`,
+  // someone has removed one of their messages
+  "delete": `[{{.User}}] deleted #{{.ID}}`,
+  // the message to edit or delete doesn't exist
+  "error-not-found": `Message #{{.ID}} doesn't exist`,
+  // the user tried to edit or delete someone else's message
+  "error-not-allowed": `You can't change message #{{.ID}}`,
+  // the user has provided the password for their role (admin or moderator)
+  "authenticated": `You are now authenticated as {{.Body}}`,
+  // the password provided with /auth is wrong (or the user doesn't have a role)
+  "error-auth-failed": `Authentication failed`,
+  // a moderator has disconnected someone
+  "kick": `[{{.User}}] kicked {{.Body}}`,
+  // a moderator has stopped someone from talking for a while
+  "mute": `[{{.User}}] muted {{.Body}} for {{.Detail}}`,
+  // a moderator has banned a username or IP address
+  "ban": `[{{.User}}] banned {{.Body}}`,
+  // a moderator has removed a ban
+  "unban": `[{{.User}}] unbanned {{.Body}}`,
+  // the user (or their IP address) has been banned from the server
+  "banned": `You are banned from this server`,
+  // the user tried to moderate without being allowed to
+  "error-permission-denied": `You aren't allowed to {{.Body}}`,
+  // the user to kick isn't connected
+  "error-user-not-found": `{{.Body}} isn't connected`,
+  // the mute duration couldn't be parsed
+  "error-invalid-duration": `"{{.Body}}" isn't a valid duration (like 10m or 1h)`,
+  // the username or IP address to unban isn't banned
+  "error-not-banned": `{{.Body}} isn't banned`,
+  // the user is muted and can't send messages
+  "error-muted": `You are muted until {{.Time.Format "15:04"}}`,
+  // the user is sending messages or commands too quickly
+  "error-rate-limited": `You are sending messages too quickly, slow down`,
+  // the message is longer than the server allows
+  "error-message-too-long": `Messages can't be longer than {{.Body}} characters`,
+  // the user kept flooding after being warned and muted
+  "error-flooding": `You have been disconnected for flooding`,
+  // the server has too many connections
+  "error-server-full": `The server is full, try again later`,
+  // there are too many connections from the user's IP address
+  "error-too-many-connections": `There are too many connections from your address`,
+  // the connection to the server was lost and the client is about to try again
+  "reconnecting": `Lost the server connection, reconnecting in {{.Detail}}`,
+  // the client has reconnected and continued its session
+  "resumed": `Reconnected as {{.User}}`,
+  // someone has mentioned the user ("@username") in another room
+  "mention": `[{{.User}}] mentioned you in "{{.Room}}": {{.Body}} (#{{.ID}})`,
+  // someone has sent the user a direct message
+  "direct": `[{{.User}}] whispers: {{.Body}}`,
+  // the direct message will be delivered when the user connects
+  "queued": `{{.User}} is offline and will get your message when they connect`,
+  // a message that was left while the user was offline
+  "inbox": `[{{.User}}] left you a message: {{.Body}}`,
+  // there are no messages in the user's mailbox
+  "inbox-empty": `Your inbox is empty`,
+  // the user's mailbox has been emptied
+  "inbox-cleared": `Your inbox has been cleared`,
+  // /msg is missing the username or the message (or /edit is missing the message or a moderation command the user)
+  "error-invalid-message": `{{if eq .Body "edit"}}Use /edit {id} {message}{{else if eq .Body "kick"}}Use /kick {username}` +
+      `{{else if eq .Body "mute"}}Use /mute {username} {duration}{{else if eq .Body "ban" "unban"}}Use /{{.Body}} {username|ip}` +
+      `{{else}}Use /msg {username} {message}{{end}}`,
+  // a server plugin didn't allow the command or message
+  "error-rejected": `Not sent: {{.Body}}`,
+  // the command needs a username but the handshake hasn't been done
+  "error-not-joined": `Use /user {username} before /{{.Body}}`,
+  // someone that is connected (from /who)
+  "who": `{{.User}} is in "{{.Room}}"`,
+  // status bar (terminal UI) while connecting, connected and waiting to reconnect
+  "status-connecting": `Connecting as {{.User}}...`,
+  "status-connected": `Connected as {{.User}} | {{.Room}}`,
+  "status-reconnecting": `Disconnected | reconnecting in {{.Detail}}`,
+  // sidebar headings (terminal UI)
+  "sidebar-rooms": `Rooms`,
+  "sidebar-members": `Members ({{.Count}})`,
+  // the user is ignoring someone else
+  "ignoring": `You are ignoring {{.User}}`,
+  // there was no room history or search results
+  "no-messages": `No messages found`,
+  // the user typed a command that doesn't exist
+  "unknown-command": `Unknown command "{{.Body}}" (see /help)`,
+  // a command and what it does (from /help)
+  "help": `{{.Body}} - {{.Detail}}`,
+  // the other names of a command (from /help {command})
+  "help-aliases": `{{plural .Count "Alias" "Aliases"}}: {{.Body}}`,
+}
+
+// values available to the message templates
+type Data struct {
+  // the user that performed the action
+  User string
+  // the room that was entered or left (or the current room)
+  Room string
+  // the message content
+  Body string
+  // the server assigned id of the message (0 if unknown)
+  ID int64
+  // the id of the message being replied to
+  Parent int64
+  // additional action details (like how long someone is muted for)
+  Detail string
+  // when the action happened
+  Time time.Time
+  // number of things being described (for use with "plural")
+  Count int
+}
+
+// parsed messages for a locale
+type Catalog struct {
+  Locale string
+  templates map[string]*template.Template
+}
+
+// functions available to the message templates
+// {{plural .Count "message" "messages"}} chooses the singular or plural form
+var templateFunctions = template.FuncMap{
+  "plural": func(count int, singular string, plural string) string {
+    if (count == 1) {
+      return singular
+    }
+    return plural
+  },
+}
+
+// load the messages for a locale ("fr_CA" will use "fr_CA.json" or "fr.json" from dir)
+func Load(locale string, dir string) (*Catalog, error) {
+  messages := map[string]string{}
+  for key, value := range DEFAULT_MESSAGES {
+    messages[key] = value
+  }
+
+  for _, name := range []string{language(locale), locale} {
+    if (name == "" || name == DEFAULT_LOCALE) {
+      continue
+    }
+    path := filepath.Join(dir, name + ".json")
+    payload, err := ioutil.ReadFile(path)
+    if (os.IsNotExist(err)) {
+      continue
+    } else if (err != nil) {
+      return nil, err
+    }
+    err = json.Unmarshal(payload, &messages)
+    if (err != nil) {
+      return nil, fmt.Errorf("invalid JSON in %s: %v", path, err)
+    }
+  }
+
+  rtn := &Catalog{Locale: locale, templates: map[string]*template.Template{}}
+  for key, value := range messages {
+    tmpl, err := template.New(key).Funcs(templateFunctions).Parse(value)
+    if (err != nil) {
+      return nil, fmt.Errorf("invalid \"%s\" message for %s: %v", key, locale, err)
+    }
+    rtn.templates[key] = tmpl
+  }
+  return rtn, nil
+}
+
+// render a message (the key itself is returned for unknown messages)
+func (catalog *Catalog) Render(key string, data Data) string {
+  tmpl, ok := catalog.templates[key]
+  if (!ok) {
+    return key
+  }
+  if (data.Time.IsZero()) {
+    data.Time = time.Now()
+  }
+
+  var rtn strings.Builder
+  err := tmpl.Execute(&rtn, data)
+  if (err != nil) {
+    return fmt.Sprintf("%s (%v)", key, err)
+  }
+  return rtn.String()
+}
+
+// return the locale to use - the provided value or the one from the environment (LC_ALL, LC_MESSAGES or LANG)
+func DetectLocale(locale string) string {
+  if (locale != "") {
+    return locale
+  }
+  for _, name := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+    value := os.Getenv(name)
+    // remove the encoding (en_US.UTF-8) and ignore the "C" and "POSIX" locales
+    value = strings.SplitN(value, ".", 2)[0]
+    if (value != "" && value != "C" && value != "POSIX") {
+      return value
+    }
+  }
+  return DEFAULT_LOCALE
+}
+
+// return the language part of a locale ("fr_CA" -> "fr")
+func language(locale string) string {
+  return strings.SplitN(strings.Replace(locale, "-", "_", -1), "_", 2)[0]
+}
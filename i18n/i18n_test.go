@@ -0,0 +1,103 @@
+package i18n
+
+import (
+  "os"
+  "path/filepath"
+  "testing"
+)
+
+// write locale files to a temporary directory (name -> JSON)
+func writeLocales(t *testing.T, locales map[string]string) string {
+  dir := t.TempDir()
+  for name, content := range locales {
+    if err := os.WriteFile(filepath.Join(dir, name + ".json"), []byte(content), 0600); err != nil {
+      t.Fatal(err)
+    }
+  }
+  return dir
+}
+
+func TestRender(t *testing.T) {
+  dir := writeLocales(t, map[string]string{
+    "fr": `{"connect": "[{{.User}}] est arrivé", "leave": "[{{.User}}] est parti"}`,
+    "fr_CA": `{"connect": "[{{.User}}] est arrivé (CA)"}`,
+  })
+  tests := []struct {
+    locale string
+    key string
+    data Data
+    expected string
+  }{
+    {"en", "connect", Data{User: "joe"}, "[joe] has entered the lobby"},
+    {"fr", "connect", Data{User: "joe"}, "[joe] est arrivé"},
+    // a country falls back to its language and then to English
+    {"fr_CA", "connect", Data{User: "joe"}, "[joe] est arrivé (CA)"},
+    {"fr_CA", "leave", Data{User: "joe"}, "[joe] est parti"},
+    {"fr-CA", "disconnect", Data{User: "joe"}, "[joe] has left the lobby"},
+    // an unknown locale is English
+    {"de", "connect", Data{User: "joe"}, "[joe] has entered the lobby"},
+    {"en", "message", Data{User: "joe", Body: "hi", ID: 4}, "[joe] says: hi (#4)"},
+    {"en", "message", Data{User: "joe", Body: "hi"}, "[joe] says: hi"},
+    // unknown messages are shown as their key
+    {"en", "no-such-message", Data{}, "no-such-message"},
+  }
+  for _, test := range tests {
+    catalog, err := Load(test.locale, dir)
+    if (err != nil) {
+      t.Fatal(err)
+    }
+    if actual := catalog.Render(test.key, test.data); actual != test.expected {
+      t.Errorf("%s %s: expected %q but got %q", test.locale, test.key, test.expected, actual)
+    }
+  }
+}
+
+func TestLoadInvalidLocale(t *testing.T) {
+  tests := map[string]string{
+    "json": `{"connect": `,
+    "template": `{"connect": "{{.User"}`,
+  }
+  for name, content := range tests {
+    dir := writeLocales(t, map[string]string{"xx": content})
+    if _, err := Load("xx", dir); err == nil {
+      t.Errorf("expected an error for invalid %s", name)
+    }
+  }
+}
+
+func TestBundledLocalesAreValid(t *testing.T) {
+  matches, _ := filepath.Glob(filepath.Join("..", "locales", "*.json"))
+  for _, match := range matches {
+    locale := filepath.Base(match[:len(match) - len(".json")])
+    catalog, err := Load(locale, filepath.Dir(match))
+    if (err != nil) {
+      t.Errorf("%s: %v", locale, err)
+      continue
+    }
+    if (len(catalog.templates) != len(DEFAULT_MESSAGES)) {
+      t.Errorf("%s has messages that aren't in the English catalog", locale)
+    }
+  }
+}
+
+func TestDetectLocale(t *testing.T) {
+  tests := []struct {
+    locale string
+    env map[string]string
+    expected string
+  }{
+    {"es", map[string]string{"LANG": "fr_FR.UTF-8"}, "es"},
+    {"", map[string]string{"LANG": "fr_FR.UTF-8"}, "fr_FR"},
+    {"", map[string]string{"LC_ALL": "de_DE", "LANG": "fr_FR"}, "de_DE"},
+    {"", map[string]string{"LANG": "C.UTF-8"}, DEFAULT_LOCALE},
+    {"", map[string]string{"LANG": "POSIX"}, DEFAULT_LOCALE},
+  }
+  for i, test := range tests {
+    for _, name := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+      t.Setenv(name, test.env[name])
+    }
+    if actual := DetectLocale(test.locale); actual != test.expected {
+      t.Errorf("test %d: expected %q but got %q", i, test.expected, actual)
+    }
+  }
+}
@@ -0,0 +1,81 @@
+// Server plugins which can be enabled for rooms with the Plugins config value (see util.Plugin)
+package plugins
+
+import (
+  "regexp"
+  "sort"
+  "strings"
+  "sync"
+  "unicode"
+  "unicode/utf8"
+  "../util"
+)
+
+// actions the profanity filter cleans up
+var PROFANITY_ACTIONS = map[string]bool{"message": true, "edit": true, "react": true, "direct": true}
+
+// replaces the ProfanityWords in messages, edits, reactions and direct messages with asterisks
+var Profanity = util.Plugin{Name: "profanity", PreBroadcast: filterProfanity}
+
+// the pattern for the current word list (rebuilt when the config changes the list)
+var profanityWords string
+var profanityPattern *regexp.Regexp
+var profanityLock sync.Mutex
+
+func filterProfanity(event *util.Event, props util.Properties) error {
+  pattern := getProfanityPattern(props.ProfanityWords)
+  if (pattern == nil || !PROFANITY_ACTIONS[event.Action.Command]) {
+    return nil
+  }
+  event.Action.Content = util.Encode(replaceWords(pattern, util.Decode(event.Action.Content)))
+  return nil
+}
+
+// replace the words matched by the pattern with asterisks
+// a word followed by a letter or number is part of a longer word and is left alone (the pattern only checks
+// what comes before the word so the boundary between two words can be used by both of them)
+func replaceWords(pattern *regexp.Regexp, content string) string {
+  var rtn strings.Builder
+  last := 0
+  for _, match := range pattern.FindAllStringSubmatchIndex(content, -1) {
+    start, end := match[2], match[3]
+    if next, _ := utf8.DecodeRuneInString(content[end:]); end < len(content) && isWordCharacter(next) {
+      continue
+    }
+    rtn.WriteString(content[last:start])
+    rtn.WriteString(strings.Repeat("*", utf8.RuneCountInString(content[start:end])))
+    last = end
+  }
+  rtn.WriteString(content[last:])
+  return rtn.String()
+}
+
+// return true for letters and numbers (in any language)
+func isWordCharacter(r rune) bool {
+  return unicode.IsLetter(r) || unicode.IsNumber(r)
+}
+
+// return the pattern matching any of the words ignoring case when they aren't after a letter or number
+// (nil if there aren't any words) - the word is the first group
+func getProfanityPattern(words []string) *regexp.Regexp {
+  profanityLock.Lock()
+  defer profanityLock.Unlock()
+
+  key := strings.Join(words, "\n")
+  if (key != profanityWords || profanityPattern == nil && len(words) > 0) {
+    quoted := []string{}
+    for _, word := range words {
+      quoted = append(quoted, regexp.QuoteMeta(word))
+    }
+    // the longest words first so "heckler" is found rather than "heck"
+    sort.SliceStable(quoted, func(i, j int) bool {
+      return len(quoted[i]) > len(quoted[j])
+    })
+    profanityWords = key
+    profanityPattern = nil
+    if (len(quoted) > 0) {
+      profanityPattern = regexp.MustCompile(`(?i)(?:^|[^\p{L}\p{N}])(` + strings.Join(quoted, "|") + `)`)
+    }
+  }
+  return profanityPattern
+}
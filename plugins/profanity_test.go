@@ -0,0 +1,38 @@
+package plugins
+
+import (
+  "testing"
+  "../util"
+)
+
+func TestProfanityReplacesWholeWords(t *testing.T) {
+  props := util.Properties{ProfanityWords: []string{"darn", "heck", "heckler", "café"}}
+  values := map[string]string{
+    "darn it": "**** it",
+    "Oh DARN!": "Oh ****!",
+    "darn darn,heck": "**** ****,****",
+    "the heckler": "the *******",
+    "darnit": "darnit",
+    "2darn": "2darn",
+    "ödarn and darnö": "ödarn and darnö",
+    "heck_": "****_",
+    "un café.": "un ****.",
+    "cafés": "cafés",
+  }
+  for value, expected := range values {
+    event := util.Event{Action: util.Action{Command: "message", Content: util.Encode(value)}}
+    filterProfanity(&event, props)
+    if actual := util.Decode(event.Action.Content); actual != expected {
+      t.Errorf("filtering %q gave %q, expected %q", value, actual, expected)
+    }
+  }
+}
+
+func TestProfanityIgnoresOtherActions(t *testing.T) {
+  props := util.Properties{ProfanityWords: []string{"darn"}}
+  event := util.Event{Action: util.Action{Command: "kick", Content: "darn"}}
+  filterProfanity(&event, props)
+  if (event.Action.Content != "darn") {
+    t.Errorf("expected only chat content to be filtered but got %q", event.Action.Content)
+  }
+}
@@ -0,0 +1,587 @@
+// The chat server - Serve handles the chat protocol for the connections accepted by a listener
+// (see ../server.go for the program which starts it)
+package server
+
+import (
+  "fmt"
+  "net"
+  "time"
+  "bufio"
+  "strings"
+  "regexp"
+  "strconv"
+  "unicode/utf8"
+  "../util"
+)
+
+const LOBBY = "lobby"
+// number of messages returned for /history and /search when no count is given
+const HISTORY_LIMIT = 20
+// longest reaction (in characters) allowed for /react
+const MAX_REACTION_LENGTH = 16
+// the commands published to clients after the handshake (see util.SendCommandCatalog)
+var COMMANDS = []util.CommandInfo{
+  {Name: "message", Args: []util.ArgInfo{{Name: "message", Rest: true}}, Description: "send a message to your room"},
+  {Name: "enter", Args: []util.ArgInfo{{Name: "room", Kind: "room"}}, Description: "enter a private room"},
+  {Name: "leave", Description: "leave your private room and go back to the lobby"},
+  {Name: "ignore", Args: []util.ArgInfo{{Name: "username", Kind: "user"}}, Description: "stop seeing messages from someone"},
+  {Name: "edit", Args: []util.ArgInfo{{Name: "id"}, {Name: "message", Rest: true}}, Description: "change one of your messages"},
+  {Name: "delete", Args: []util.ArgInfo{{Name: "id"}}, Description: "remove one of your messages"},
+  {Name: "reply", Args: []util.ArgInfo{{Name: "id"}, {Name: "message", Rest: true}}, Description: "reply to a message"},
+  {Name: "react", Args: []util.ArgInfo{{Name: "id"}, {Name: "reaction"}}, Description: "react to a message with an emoji or short word"},
+  {Name: "history", Args: []util.ArgInfo{{Name: "count", Optional: true}}, Description: "show the most recent messages in your room"},
+  {Name: "search", Args: []util.ArgInfo{{Name: "query", Rest: true}}, Description: "search the messages in your room"},
+  {Name: "msg", Args: []util.ArgInfo{{Name: "username", Kind: "user"}, {Name: "message", Rest: true}},
+      Description: "send a message to only one user (it is kept for them if they are offline)"},
+  {Name: "inbox", Args: []util.ArgInfo{{Name: "clear", Optional: true}},
+      Description: "show (or clear) the messages left for you while you were offline"},
+  {Name: "who", Description: "list everyone that is connected and the room they are in"},
+  {Name: "auth", Args: []util.ArgInfo{{Name: "password"}}, Description: "provide the password for your admin or moderator role"},
+  {Name: "kick", Args: []util.ArgInfo{{Name: "username", Kind: "user"}}, Description: "disconnect a user (moderators only)"},
+  {Name: "mute", Args: []util.ArgInfo{{Name: "username", Kind: "user"}, {Name: "duration"}},
+      Description: "stop a user from talking for a while (moderators only)"},
+  {Name: "ban", Args: []util.ArgInfo{{Name: "username|ip", Kind: "user"}},
+      Description: "disconnect and ban a username or IP address (moderators only)"},
+  {Name: "unban", Args: []util.ArgInfo{{Name: "username|ip"}}, Description: "remove a ban (moderators only)"},
+  {Name: "ping", Args: []util.ArgInfo{{Name: "value", Optional: true}}, Description: "check that the server is there"},
+  {Name: "disconnect", Description: "disconnect from the chat server"},
+}
+// actions muted users aren't allowed to do
+var MUTED_ACTIONS = map[string]bool{"message": true, "edit": true, "reply": true, "react": true, "msg": true}
+
+
+// handle chat connections accepted by the listener until it is closed (the error that stopped it is returned)
+func Serve(listener net.Listener) error {
+  for {
+    // accept connections
+    conn, err := listener.Accept()
+    if (err != nil) {
+      return err
+    }
+
+    // banned IP addresses aren't allowed to connect at all
+    if (util.IsBanned("", util.RemoteIP(conn))) {
+      util.Infof("Refusing connection from banned address %s", util.RemoteIP(conn))
+      conn.Write([]byte("/banned\n"))
+      conn.Close()
+      continue
+    }
+    props := util.LoadConfig()
+    if (!checkConnectionLimits(conn, props)) {
+      conn.Close()
+      continue
+    }
+
+    // keep track of the client details
+    client := util.Client{Connection: conn, Room: LOBBY}
+    client.Register();
+
+    // allow non-blocking client request handling
+    channel := make(chan string)
+    go waitForInput(channel, &client)
+    go handleInput(channel, &client)
+    go heartbeat(&client)
+
+    util.SendClientMessage("ready", props.Port, &client, true, props)
+  }
+}
+
+// refuse the connection if the server (or the connection's IP address) already has too many connections
+// false is returned if the connection should be closed
+func checkConnectionLimits(conn net.Conn, props util.Properties) bool {
+  ip := util.RemoteIP(conn)
+  connected := util.ConnectedClients()
+  if (props.MaxConnections > 0 && len(connected) >= props.MaxConnections) {
+    util.Warnf("Refusing connection from %s: the server has %d connections", ip, len(connected))
+    conn.Write([]byte("/error server-full\n"))
+    return false
+  }
+
+  count := 0
+  for _, client := range connected {
+    if (client.IP() == ip) {
+      count++
+    }
+  }
+  if (props.MaxConnectionsPerIP > 0 && count >= props.MaxConnectionsPerIP) {
+    util.Warnf("Refusing connection from %s: it already has %d connections", ip, count)
+    conn.Write([]byte("/error too-many-connections\n"))
+    return false
+  }
+  return true
+}
+
+// wait for client input (buffered by newlines) and signal the channel
+// the client is disconnected if it doesn't send "/user" in time or stops sending anything (including "/pong")
+func waitForInput(out chan string, client *util.Client) {
+  defer close(out)
+  connected := time.Now()
+ 
+  reader := bufio.NewReader(client.Connection)
+  for {
+    client.Connection.SetReadDeadline(readDeadline(client, connected, util.LoadConfig()))
+    line, err := reader.ReadBytes('\n')
+    if err != nil {
+      username, _, handshake := client.Handshake()
+      if netErr, ok := err.(net.Error); ok && netErr.Timeout() && !handshake {
+        util.Infof("Disconnecting %s: no handshake", client.IP())
+      } else if ok && netErr.Timeout() {
+        util.Infof("Disconnecting %s (%s): idle", username, client.IP())
+      }
+      // connection has been lost, remove the client (its session can be resumed for a while)
+      client.Lost(time.Duration(util.LoadConfig().SessionGracePeriod) * time.Second)
+      return
+    }
+    out <- string(line)
+  }
+}
+
+// when the next input must be received by (the zero time for no deadline)
+func readDeadline(client *util.Client, connected time.Time, props util.Properties) time.Time {
+  if _, _, handshake := client.Handshake(); !handshake {
+    if (props.HandshakeTimeout > 0) {
+      return connected.Add(time.Duration(props.HandshakeTimeout) * time.Second)
+    }
+    return time.Time{}
+  }
+  if (props.IdleTimeout > 0) {
+    return time.Now().Add(time.Duration(props.IdleTimeout) * time.Second)
+  }
+  return time.Time{}
+}
+
+// send "/ping {unix seconds}" to the client every PingInterval so it answers with "/pong" (keeping the connection
+// from going idle and letting us find dead peers) - this stops when the client is closed
+// only clients that finished the handshake with protocol 2 or later understand pings
+func heartbeat(client *util.Client) {
+  for client.IsConnected() {
+    interval := util.LoadConfig().PingInterval
+    if (interval <= 0) {
+      // pings are turned off - check again later in case the config is reloaded
+      time.Sleep(time.Minute)
+      continue
+    }
+    time.Sleep(time.Duration(interval) * time.Second)
+    if _, protocol, handshake := client.Handshake(); handshake && protocol >= util.PROTOCOL_VERSION {
+      fmt.Fprintf(client.Connection, "/ping %v\n", time.Now().Unix())
+    }
+  }
+}
+
+// listen for channel updates for a client and handle the message
+// messages must be in the format of /{action} {content} where content is optional depending on the action
+// supported actions are "user", "message", "enter", "leave", "ignore", "edit", "delete", "reply", "react", "history", "search", "auth",
+// "resume", "msg", "inbox", "who", "kick", "mute", "ban", "unban", "ping", "pong" and "disconnect".  the "user" must be set before any chat messages are allowed
+func handleInput(in <-chan string, client *util.Client) {
+
+  for {
+    message, ok := <- in
+    if (!ok) {
+      // the connection has been closed
+      return
+    }
+    if (message != "") {
+      // the config can be reloaded while the server is running
+      props := util.LoadConfig()
+      message = strings.TrimSpace(message)
+      action, body := getAction(message)
+
+      if (!checkRate(action, body, client, props)) {
+        continue
+      }
+
+      if muted, until := client.IsMuted(); muted && MUTED_ACTIONS[action] {
+        util.SendClientResponse("error", "", "muted " + strconv.FormatInt(until.Unix(), 10), client)
+        continue
+      }
+
+      action, body, ok := util.PreHandle(client, action, body, props)
+      if (!ok) {
+        // a plugin has handled (or rejected) the command
+        continue
+      }
+
+      if (action != "") {
+        switch action {
+
+          // the user has submitted a message
+          case "message":
+            if (client.Username != "") {
+              if message, ok := util.BroadcastAction(util.Action{Command: "message", Content: body}, client, props); ok {
+                util.NotifyMentions(message, client)
+              }
+            }
+
+          // heartbeat - answer the client's ping (our pings are answered with "pong" which only needs to be received)
+          case "ping":
+            util.SendClientResponse("pong", "", body, client)
+          case "pong":
+
+          // the client understands a newer protocol version (sent before "user")
+          case "protocol":
+            client.Protocol, _ = strconv.Atoi(body)
+
+          // the user has provided their username (initialization handshake)
+          case "user":
+            if (util.IsBanned(body, client.IP())) {
+              util.Infof("Refusing banned user %s from %s", body, client.IP())
+              util.SendClientResponse("banned", "", "", client)
+              client.Close(false)
+            } else {
+              client.SetUsername(body)
+              client.FinishHandshake()
+              util.SendClientMessage("connect", "", client, false, props)
+              if (client.Protocol >= util.PROTOCOL_VERSION && props.SessionGracePeriod > 0) {
+                util.SendClientResponse("session", "", client.StartSession(), client)
+              }
+              util.SendCommandCatalog(COMMANDS, client)
+              util.RememberUser(body)
+              deliverMail(client)
+            }
+
+          // the client has reconnected and wants to continue its session (instead of "user")
+          case "resume":
+            if (client.Username != "" || !client.Resume(body)) {
+              util.SendClientResponse("error", "", "session-expired", client)
+            } else if (util.IsBanned(client.Username, client.IP())) {
+              util.Infof("Refusing banned user %s from %s", client.Username, client.IP())
+              util.SendClientResponse("banned", "", "", client)
+              // the lost connection sends the disconnect
+              client.Close(false)
+            } else {
+              client.FinishHandshake()
+              util.Infof("%s resumed their session from %s", client.Username, client.IP())
+              util.SendClientResponse("resumed", client.Username, client.Room, client)
+              util.SendCommandCatalog(COMMANDS, client)
+              deliverMail(client)
+            }
+
+          // the user is providing the password for their admin or moderator role
+          case "auth":
+            if (client.Authenticate(body)) {
+              role := "moderator"
+              if (client.IsAdmin()) {
+                role = "admin"
+              }
+              util.SendClientResponse("authenticated", "", role, client)
+            } else {
+              util.SendClientResponse("error", "", "auth-failed", client)
+            }
+
+          // a moderator is disconnecting a user
+          case "kick":
+            targets := util.FindClients(body)
+            if (body == "") {
+              util.SendClientResponse("error", "", "invalid-message " + action, client)
+            } else if (!checkModerator(action, body, client)) {
+              // the error has already been sent
+            } else if (len(targets) == 0) {
+              util.SendClientResponse("error", "", "user-not-found " + body, client)
+            } else {
+              util.BroadcastAction(util.Action{Command: "kick", Content: body}, client, props)
+              for _, target := range targets {
+                target.Close(false)
+              }
+            }
+
+          // a moderator is stopping a user from talking for a while ("/mute {username} {duration like 10m}")
+          case "mute":
+            username, value := getUsername(body)
+            duration, err := time.ParseDuration(value)
+            if (username == "") {
+              util.SendClientResponse("error", "", "invalid-message " + action, client)
+            } else if (!checkModerator(action, username, client)) {
+              // the error has already been sent
+            } else if (err != nil || duration <= 0) {
+              util.SendClientResponse("error", "", "invalid-duration " + value, client)
+            } else {
+              util.Mute(username, time.Now().Add(duration))
+              util.BroadcastAction(util.Action{Command: "mute", Content: username + " " + value}, client, props)
+            }
+
+          // a moderator is banning a username or IP address (anyone connected that matches is disconnected)
+          // the address is logged but isn't shared with the other users (only the part that doesn't identify anyone)
+          case "ban":
+            // IPv6 addresses arrive encoded ("::1" is sent as "%3A%3A1")
+            value := util.Decode(body)
+            targets := bannedClients(value)
+            if (value == "") {
+              util.SendClientResponse("error", "", "invalid-message " + action, client)
+            } else if (checkModerator(action, value, client) && checkModerators(action, targets, client)) {
+              err := util.Ban(value)
+              if (err != nil) {
+                util.Errorf("Can't save ban file: %v", err)
+              }
+              util.BroadcastAction(util.Action{Command: "ban", Content: body}, client, props)
+              for _, target := range targets {
+                target.Close(false)
+              }
+            }
+
+          // a moderator is removing a ban
+          case "unban":
+            value := util.Decode(body)
+            if (value == "") {
+              util.SendClientResponse("error", "", "invalid-message " + action, client)
+            } else if (checkModerator(action, "", client)) {
+              ok, err := util.Unban(value)
+              if (err != nil) {
+                util.Errorf("Can't save ban file: %v", err)
+              }
+              if (ok) {
+                util.BroadcastAction(util.Action{Command: "unban", Content: body}, client, props)
+              } else {
+                util.SendClientResponse("error", "", "not-banned " + body, client)
+              }
+            }
+
+          // the user is disconnecting
+          case "disconnect":
+            client.Close(false);
+
+          // the user is ignoring someone
+          case "ignore":
+            client.Ignore(body)
+            // only the user needs to know
+            ignoring := util.LogClientAction(util.Action{Command: "ignoring", Content: body}, client, props)
+            util.SendClientAction("ignoring", ignoring, client)
+
+          // the user is entering a room
+          case "enter":
+            if (body != "") {
+              client.SetRoom(body)
+              util.SendClientMessage("enter", body, client, false, props)
+            }
+
+          // the user is leaving the current room
+          case "leave":
+            if (client.Room != LOBBY) {
+              util.SendClientMessage("leave", client.Room, client, false, props)
+              client.SetRoom(LOBBY)
+            }
+
+          // the user is changing or removing one of their messages
+          case "edit", "delete":
+            id, text := getTarget(body)
+            message, ok := util.FindMessage(id)
+            if (!ok || message.Deleted) {
+              util.SendClientResponse("error", "", "not-found " + strconv.FormatInt(id, 10), client)
+            } else if (message.Username != client.Username && !client.IsModerator()) {
+              util.SendClientResponse("error", "", "not-allowed " + strconv.FormatInt(id, 10), client)
+            } else if (action == "edit" && strings.TrimSpace(text) == "") {
+              util.SendClientResponse("error", "", "invalid-message edit", client)
+            } else if (client.Username != "") {
+              revision, ok := util.BroadcastAction(util.Action{Command: action, Content: text, Target: id, Room: message.Room}, client, props)
+              if (ok && client.Room != message.Room) {
+                // only the message's room hears about it so let the user know it worked
+                util.SendClientAction(action, revision, client)
+              }
+            }
+
+          // the user is replying to a message (the reply goes to the room of the message)
+          case "reply":
+            id, text := getTarget(body)
+            message, ok := util.FindMessage(id)
+            if (!ok || message.Deleted) {
+              util.SendClientResponse("error", "", "not-found " + strconv.FormatInt(id, 10), client)
+            } else if (text != "" && client.Username != "") {
+              reply, ok := util.BroadcastAction(util.Action{Command: "message", Content: text, Target: id, Room: message.Room}, client, props)
+              if (ok) {
+                util.NotifyMentions(reply, client)
+              }
+            }
+
+          // the user is reacting to a message (with an emoji or short word)
+          case "react":
+            id, reaction := getTarget(body)
+            message, ok := util.FindMessage(id)
+            if (!ok || message.Deleted) {
+              util.SendClientResponse("error", "", "not-found " + strconv.FormatInt(id, 10), client)
+            } else if (reaction == "" || strings.Contains(reaction, " ") || utf8.RuneCountInString(reaction) > MAX_REACTION_LENGTH) {
+              util.SendClientResponse("error", "", "invalid-reaction " + strconv.FormatInt(id, 10), client)
+            } else if (client.Username != "" && !util.HasReacted(id, client.Username, reaction)) {
+              util.BroadcastAction(util.Action{Command: "react", Content: reaction, Target: id, Room: message.Room}, client, props)
+            }
+
+          // the user wants to see the recent messages in their room
+          case "history":
+            limit, err := strconv.Atoi(body)
+            if (err != nil || limit <= 0) {
+              limit = HISTORY_LIMIT
+            }
+            messages := util.QueryRoomMessages(client.Room, limit)
+            for _, message := range messages {
+              util.SendClientAction("history", message, client)
+            }
+            if (len(messages) == 0) {
+              util.SendClientResponse("history", "", "", client)
+            }
+
+          // the user is sending a message to only one other user ("/msg {username} {message}")
+          // messages for users that aren't connected are left in their mailbox
+          case "msg":
+            recipient, text := getUsername(body)
+            targets := util.FindClients(recipient)
+            if (client.Username == "") {
+              util.SendClientResponse("error", "", "not-joined " + action, client)
+            } else if (recipient == "" || text == "") {
+              util.SendClientResponse("error", "", "invalid-message", client)
+            } else if (len(targets) == 0 && !util.IsKnownUser(recipient)) {
+              util.SendClientResponse("error", "", "user-not-found " + recipient, client)
+            } else if direct, recipients, ok := util.PreBroadcast(util.Action{Command: "direct", Content: text, Recipient: recipient, Room: client.Room}, targets, client, props); ok {
+              direct = util.LogClientAction(direct, client, props)
+              if (len(targets) == 0) {
+                util.QueueMail(recipient, direct)
+                util.SendClientResponse("queued", recipient, "", client)
+              }
+              for _, target := range recipients {
+                if (!target.IsIgnoring(client.Username)) {
+                  util.SendClientAction("direct", direct, target)
+                }
+              }
+            }
+
+          // the user is reviewing ("/inbox") or emptying ("/inbox clear") the messages left while they were offline
+          case "inbox":
+            if (client.Username == "") {
+              util.SendClientResponse("error", "", "not-joined " + action, client)
+            } else if (body == "clear") {
+              util.ClearMail(client.Username)
+              util.SendClientResponse("inbox-cleared", "", "", client)
+            } else {
+              mail := util.ReadMail(client.Username, false)
+              for _, message := range mail {
+                util.SendClientAction("inbox", message.Action, client)
+              }
+              if (len(mail) == 0) {
+                util.SendClientResponse("inbox", "", "", client)
+              }
+            }
+
+          // the user wants to know who is connected - "/who [{username}] {room}" is sent for each user
+          // followed by an empty "/who"
+          case "who":
+            for _, other := range util.ConnectedClients() {
+              if username, room := other.Identity(); username != "" {
+                util.SendClientResponse("who", username, room, client)
+              }
+            }
+            util.SendClientResponse("who", "", "", client)
+
+          // the user is searching the messages in their room
+          case "search":
+            results := util.SearchMessages("message", util.Decode(body), "", client.Room, HISTORY_LIMIT)
+            for _, result := range results {
+              util.SendClientAction("search", result.Action, client)
+            }
+            if (len(results) == 0) {
+              util.SendClientResponse("search", "", "", client)
+            }
+
+          default:
+            util.SendClientMessage("unrecognized", action, client, true, props)
+        }
+      }
+    }
+  }
+}
+
+// parse out message contents (/{action} {message}) and return individual values
+func getAction(message string) (string, string) {
+  actionRegex, _ := regexp.Compile(`^\/([^\s]*)\s*(.*)$`)
+  res := actionRegex.FindAllStringSubmatch(message, -1)
+  if (len(res) == 1) {
+    return res[0][1], res[0][2]
+  }
+  return "", ""
+}
+
+// apply the rate and message length limits - warn, mute and finally disconnect flooding clients
+// false is returned if the command should be dropped
+func checkRate(action string, body string, client *util.Client, props util.Properties) bool {
+  switch client.CheckRate(MUTED_ACTIONS[action], utf8.RuneCountInString(body), props) {
+    case util.RATE_TOO_LONG:
+      util.SendClientResponse("error", "", "message-too-long " + strconv.Itoa(props.MaxMessageLength), client)
+      return false
+
+    // the client is told every time a command is dropped (only some of them count as warnings)
+    case util.RATE_DROP, util.RATE_WARN:
+      util.SendClientResponse("error", "", "rate-limited", client)
+      return false
+
+    case util.RATE_MUTE:
+      duration := time.Duration(props.FloodMuteSeconds) * time.Second
+      until := time.Now().Add(duration)
+      util.Warnf("Muting %s (%s) for flooding", client.Username, client.IP())
+      util.Mute(client.Username, until)
+      util.LogClientAction(util.Action{Command: "flood", Content: "mute " + duration.String()}, client, props)
+      util.SendClientResponse("error", "", "muted " + strconv.FormatInt(until.Unix(), 10), client)
+      return false
+
+    case util.RATE_DISCONNECT:
+      util.Warnf("Disconnecting %s (%s) for flooding", client.Username, client.IP())
+      util.LogClientAction(util.Action{Command: "flood", Content: "disconnect"}, client, props)
+      util.SendClientResponse("error", "", "flooding", client)
+      client.Close(true)
+      return false
+  }
+  return true
+}
+
+// send the user the messages that were left for them while they were offline
+func deliverMail(client *util.Client) {
+  for _, message := range util.ReadMail(client.Username, true) {
+    util.SendClientAction("inbox", message.Action, client)
+  }
+}
+
+// make sure the client is allowed to moderate the target user (an error is sent if not)
+// an empty target only checks that the client is a moderator
+func checkModerator(action string, target string, client *util.Client) bool {
+  if (!client.IsModerator() || (target != "" && !client.CanModerate(target))) {
+    util.SendClientResponse("error", "", "permission-denied " + action, client)
+    return false
+  }
+  return true
+}
+
+// make sure the client is allowed to moderate every one of the target users (an error is sent if not)
+func checkModerators(action string, targets []*util.Client, client *util.Client) bool {
+  for _, target := range targets {
+    if (target.Username != "" && !client.CanModerate(target.Username)) {
+      util.SendClientResponse("error", "", "permission-denied " + action, client)
+      return false
+    }
+  }
+  return true
+}
+
+// return the connected clients a ban applies to (the username or everyone connected from the IP address)
+func bannedClients(value string) []*util.Client {
+  rtn := []*util.Client{}
+  for _, target := range util.ConnectedClients() {
+    if username, _ := target.Identity(); username == value || (util.IsIPAddress(value) && target.IP() == value) {
+      rtn = append(rtn, target)
+    }
+  }
+  return rtn
+}
+
+// parse out the username and remaining content of "{username} {content}"
+func getUsername(body string) (string, string) {
+  parts := strings.SplitN(body, " ", 2)
+  if (len(parts) == 1) {
+    return parts[0], ""
+  }
+  return parts[0], strings.TrimSpace(parts[1])
+}
+
+// parse out the message id and remaining content of "{id} {content}"
+func getTarget(body string) (int64, string) {
+  parts := strings.SplitN(body, " ", 2)
+  id, _ := strconv.ParseInt(parts[0], 10, 64)
+  if (len(parts) == 1) {
+    return id, ""
+  }
+  return id, strings.TrimSpace(parts[1])
+}
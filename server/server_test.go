@@ -0,0 +1,171 @@
+package server
+
+import (
+  "bufio"
+  "fmt"
+  "net"
+  "path/filepath"
+  "regexp"
+  "strconv"
+  "strings"
+  "testing"
+  "time"
+  "../util"
+)
+
+// start a chat server in the test and return its address
+func startServer(t *testing.T) string {
+  dir := t.TempDir()
+  t.Setenv("CHAT_MAILBOX_FILE", filepath.Join(dir, "mailbox.json"))
+  t.Setenv("CHAT_BAN_FILE", filepath.Join(dir, "bans.json"))
+  t.Setenv("CHAT_LOG_FILE", filepath.Join(dir, "chat.log"))
+  // the tests talk faster than people do
+  t.Setenv("CHAT_MESSAGES_PER_MINUTE", "0")
+  t.Setenv("CHAT_COMMANDS_PER_MINUTE", "0")
+  listener, err := net.Listen("tcp", "127.0.0.1:0")
+  if (err != nil) {
+    t.Fatal(err)
+  }
+  t.Cleanup(func() {
+    listener.Close()
+  })
+  go Serve(listener)
+  return listener.Addr().String()
+}
+
+// a user connected to the test server
+type user struct {
+  conn net.Conn
+  reader *bufio.Reader
+}
+
+func connect(t *testing.T, address string, username string) *user {
+  conn, err := net.Dial("tcp", address)
+  if (err != nil) {
+    t.Fatal(err)
+  }
+  t.Cleanup(func() {
+    conn.Close()
+  })
+  fmt.Fprintf(conn, "/protocol %v\n/user %v\n", util.PROTOCOL_VERSION, username)
+  return &user{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (user *user) send(command string, body string) {
+  fmt.Fprintf(user.conn, "/%v %v\n", command, body)
+}
+
+// "/{command} [{username}] {{id} {time}} {body}" from the server
+var responseRegex = regexp.MustCompile(`^/(\S*)\s?(?:\[[^\]]*\])?\s*(?:\{(\d+) \d+\}\s?)?(.*)$`)
+
+// return the id and body of the next line from the server for one of the commands (other lines are skipped)
+func (user *user) next(t *testing.T, commands ...string) (string, int64, string) {
+  t.Helper()
+  user.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+  for {
+    line, err := user.reader.ReadString('\n')
+    if (err != nil) {
+      t.Fatalf("expected one of %v: %v", commands, err)
+    }
+    match := responseRegex.FindStringSubmatch(strings.TrimSpace(line))
+    for _, command := range commands {
+      if (match != nil && match[1] == command) {
+        id, _ := strconv.ParseInt(match[2], 10, 64)
+        return command, id, match[3]
+      }
+    }
+  }
+}
+
+// return the bodies of the next count lines from the server for the command
+func (user *user) read(t *testing.T, command string, count int) []string {
+  t.Helper()
+  rtn := []string{}
+  for len(rtn) < count {
+    _, _, body := user.next(t, command)
+    rtn = append(rtn, body)
+  }
+  return rtn
+}
+
+func TestHistoryAndSearch(t *testing.T) {
+  address := startServer(t)
+  ann := connect(t, address, "ann")
+  // a room of its own so actions from other runs aren't included
+  room := fmt.Sprintf("history-%d", time.Now().UnixNano())
+  ann.send("enter", room)
+  ann.read(t, "enter", 1)
+  for _, message := range []string{"alpha one", "beta two", "alpha three"} {
+    ann.send("message", util.Encode(message))
+  }
+  ann.read(t, "message", 3)
+
+  tests := []struct {
+    command string
+    body string
+    expected []string
+  }{
+    {"history", "", []string{"alpha one", "beta two", "alpha three"}},
+    {"history", "2", []string{"beta two", "alpha three"}},
+    {"history", "nonsense", []string{"alpha one", "beta two", "alpha three"}},
+    {"search", "beta", []string{"beta two"}},
+    {"search", "gamma", []string{""}},
+  }
+  for _, test := range tests {
+    ann.send(test.command, test.body)
+    actual := ann.read(t, test.command, len(test.expected))
+    if (strings.Join(actual, "|") != strings.Join(test.expected, "|")) {
+      t.Errorf("/%v %v: expected %q but got %q", test.command, test.body, test.expected, actual)
+    }
+  }
+
+  // both alpha messages match but in order of relevance
+  ann.send("search", "alpha")
+  actual := "|" + strings.Join(ann.read(t, "search", 2), "|") + "|"
+  if (!strings.Contains(actual, "|alpha one|") || !strings.Contains(actual, "|alpha three|")) {
+    t.Errorf("expected both alpha messages but got %q", actual)
+  }
+}
+
+func TestEditsRepliesAndReactions(t *testing.T) {
+  address := startServer(t)
+  ann := connect(t, address, "ann")
+  bob := connect(t, address, "bob")
+  room := fmt.Sprintf("changes-%d", time.Now().UnixNano())
+  ann.send("enter", room)
+  ann.next(t, "enter")
+  // everyone hears about bob entering so ann knows bob is in the room before she sends anything
+  bob.send("enter", room)
+  ann.next(t, "enter")
+  ann.send("message", "hello")
+  _, id, _ := ann.next(t, "message")
+  bob.next(t, "message")
+
+  tests := []struct {
+    user *user
+    command string
+    body string
+    // the command and body the user gets back ("%d" is the message id)
+    expected string
+    expectedBody string
+  }{
+    {bob, "edit", "%d changed", "error", "not-allowed %d"},
+    {ann, "edit", "%d", "error", "invalid-message edit"},
+    {ann, "edit", "%d changed", "edit", "%d changed"},
+    {bob, "react", "%d +1", "react", "%d +1"},
+    {bob, "react", "%d two words", "error", "invalid-reaction %d"},
+    {bob, "react", "%d " + strings.Repeat("x", MAX_REACTION_LENGTH + 1), "error", "invalid-reaction %d"},
+    {bob, "reply", "%d answer", "reply", "%d answer"},
+    {bob, "reply", "0 answer", "error", "not-found 0"},
+    {ann, "delete", "%d", "delete", "%d"},
+    {bob, "react", "%d +1", "error", "not-found %d"},
+  }
+  for _, test := range tests {
+    test.user.send(test.command, strings.Replace(test.body, "%d", strconv.FormatInt(id, 10), 1))
+    command, _, body := test.user.next(t, test.expected)
+    expected := strings.Replace(test.expectedBody, "%d", strconv.FormatInt(id, 10), 1)
+    if (body != expected) {
+      t.Errorf("/%v %v: expected /%v %q but got /%v %q", test.command, test.body, test.expected, expected, command, body)
+    }
+  }
+}
@@ -0,0 +1,575 @@
+// Full screen terminal UI for the chat client using ANSI escape codes (the terminal is put into raw mode with stty)
+// The screen has a scrollback pane, a sidebar on the right, a status bar and an input line with editing, history
+// and tab completion
+package tui
+
+import (
+  "bufio"
+  "errors"
+  "fmt"
+  "os"
+  "os/exec"
+  "os/signal"
+  "strconv"
+  "strings"
+  "sync"
+  "syscall"
+  "unicode/utf8"
+)
+
+// number of lines kept in the scrollback pane
+const SCROLLBACK_LIMIT = 1000
+// number of columns used by the sidebar (it is hidden on narrow terminals)
+const SIDEBAR_WIDTH = 24
+// narrowest scrollback pane shown next to the sidebar
+const MIN_PANE_WIDTH = 30
+// shown before the input line
+const PROMPT = "> "
+
+// terminal escape codes
+const (
+  ESCAPE = "\x1b"
+  RESET = ESCAPE + "[0m"
+  REVERSE = ESCAPE + "[7m"
+  CLEAR_LINE = ESCAPE + "[K"
+  HIDE_CURSOR = ESCAPE + "[?25l"
+  SHOW_CURSOR = ESCAPE + "[?25h"
+  ALTERNATE_SCREEN = ESCAPE + "[?1049h"
+  NORMAL_SCREEN = ESCAPE + "[?1049l"
+)
+
+// returned by ReadLine when the user presses Ctrl-C (or Ctrl-D on an empty line)
+var ErrInterrupted = errors.New("interrupted")
+
+// the terminal screen
+type Screen struct {
+  lock sync.Mutex
+  width, height int
+  // scrollback lines (newest last) - lines can contain color escape codes
+  lines []string
+  // number of rows the pane is scrolled up from the newest line
+  scroll int
+  sidebar []string
+  status string
+  // the line being typed and the cursor position in it
+  input []rune
+  cursor int
+  // previously entered lines (oldest first) and the entry being shown (len(history) for the current line)
+  history []string
+  historyIndex int
+  // the current line while browsing the history
+  draft string
+  // returns the possible completions of the input before the cursor (nil for no tab completion)
+  completer func(line string) []string
+  // stty settings to restore when the screen is stopped
+  terminalState string
+  stopped bool
+  reader *bufio.Reader
+}
+
+// take over the terminal - Stop must be called to give it back
+func Start() (*Screen, error) {
+  state, err := stty("-g")
+  if (err != nil) {
+    return nil, fmt.Errorf("can't read the terminal settings: %v", err)
+  }
+  _, err = stty("raw", "-echo")
+  if (err != nil) {
+    return nil, fmt.Errorf("can't use raw mode: %v", err)
+  }
+
+  screen := &Screen{terminalState: strings.TrimSpace(state), reader: bufio.NewReader(os.Stdin)}
+  screen.updateSize()
+  os.Stdout.WriteString(ALTERNATE_SCREEN)
+  screen.Redraw()
+
+  resized := make(chan os.Signal, 1)
+  signal.Notify(resized, syscall.SIGWINCH)
+  go func() {
+    for range resized {
+      screen.updateSize()
+      screen.Redraw()
+    }
+  }()
+  return screen, nil
+}
+
+// give the terminal back the way we found it
+func (screen *Screen) Stop() {
+  screen.lock.Lock()
+  defer screen.lock.Unlock()
+  if (screen.stopped) {
+    return
+  }
+  screen.stopped = true
+  os.Stdout.WriteString(SHOW_CURSOR + NORMAL_SCREEN)
+  stty(screen.terminalState)
+}
+
+// add a line to the scrollback pane
+func (screen *Screen) Print(line string) {
+  screen.lock.Lock()
+  defer screen.lock.Unlock()
+
+  for _, value := range strings.Split(strings.TrimRight(line, "\n"), "\n") {
+    screen.lines = append(screen.lines, clean(value))
+  }
+  if (len(screen.lines) > SCROLLBACK_LIMIT) {
+    screen.lines = screen.lines[len(screen.lines) - SCROLLBACK_LIMIT:]
+  }
+  screen.draw()
+}
+
+// ring the terminal bell
+func (screen *Screen) Bell() {
+  os.Stdout.WriteString("\a")
+}
+
+// set the text shown in the status bar
+func (screen *Screen) SetStatus(status string) {
+  screen.lock.Lock()
+  defer screen.lock.Unlock()
+  screen.status = clean(status)
+  screen.draw()
+}
+
+// set the lines shown in the sidebar
+func (screen *Screen) SetSidebar(lines []string) {
+  screen.lock.Lock()
+  defer screen.lock.Unlock()
+  screen.sidebar = []string{}
+  for _, line := range lines {
+    screen.sidebar = append(screen.sidebar, clean(line))
+  }
+  screen.draw()
+}
+
+// set how the input line is completed when tab is pressed
+// the completer is given the input before the cursor and returns the possible replacements for it
+func (screen *Screen) SetCompleter(completer func(line string) []string) {
+  screen.lock.Lock()
+  defer screen.lock.Unlock()
+  screen.completer = completer
+}
+
+// draw the whole screen again
+func (screen *Screen) Redraw() {
+  screen.lock.Lock()
+  defer screen.lock.Unlock()
+  screen.draw()
+}
+
+// wait for the user to type a line and press enter
+// the line can be edited (arrows, home/end, backspace/delete, Ctrl-U) and previous lines recalled with up/down
+// the scrollback pane is scrolled with page up/down
+func (screen *Screen) ReadLine() (string, error) {
+  for {
+    key, err := screen.readKey()
+    if (err != nil) {
+      return "", err
+    }
+
+    screen.lock.Lock()
+    line, done, err := screen.handleKey(key)
+    screen.draw()
+    screen.lock.Unlock()
+    if (done || err != nil) {
+      return line, err
+    }
+  }
+}
+
+// read a single key press - escape sequences (arrows, page up, ...) are returned whole
+func (screen *Screen) readKey() (string, error) {
+  r, _, err := screen.reader.ReadRune()
+  if (err != nil || r != 27) {
+    return string(r), err
+  }
+
+  // ESC [ {parameters} {final byte} (or ESC O {letter} for some terminals)
+  next, _, err := screen.reader.ReadRune()
+  if (err != nil || (next != '[' && next != 'O')) {
+    return ESCAPE, err
+  }
+  sequence := ESCAPE + string(next)
+  for {
+    b, err := screen.reader.ReadByte()
+    if (err != nil) {
+      return sequence, err
+    }
+    sequence += string(b)
+    if (b >= 0x40 && b <= 0x7e) {
+      return sequence, nil
+    }
+  }
+}
+
+// update the input line for a key press (screen.lock must be held)
+// done is true (with the line) when enter has been pressed
+func (screen *Screen) handleKey(key string) (line string, done bool, err error) {
+  switch key {
+    // enter
+    case "\r", "\n":
+      line = string(screen.input)
+      if (line != "" && (len(screen.history) == 0 || screen.history[len(screen.history) - 1] != line)) {
+        screen.history = append(screen.history, line)
+      }
+      screen.historyIndex = len(screen.history)
+      screen.setInput("")
+      screen.scroll = 0
+      return line, true, nil
+
+    // Ctrl-C or Ctrl-D on an empty line
+    case "\x03":
+      return "", false, ErrInterrupted
+    case "\x04":
+      if (len(screen.input) == 0) {
+        return "", false, ErrInterrupted
+      }
+
+    // backspace
+    case "\x7f", "\x08":
+      if (screen.cursor > 0) {
+        screen.input = append(screen.input[:screen.cursor - 1], screen.input[screen.cursor:]...)
+        screen.cursor--
+      }
+
+    // delete
+    case ESCAPE + "[3~":
+      if (screen.cursor < len(screen.input)) {
+        screen.input = append(screen.input[:screen.cursor], screen.input[screen.cursor + 1:]...)
+      }
+
+    // Ctrl-U clears the line
+    case "\x15":
+      screen.setInput("")
+
+    // left, right, home and end
+    case ESCAPE + "[D", ESCAPE + "OD":
+      if (screen.cursor > 0) {
+        screen.cursor--
+      }
+    case ESCAPE + "[C", ESCAPE + "OC":
+      if (screen.cursor < len(screen.input)) {
+        screen.cursor++
+      }
+    case ESCAPE + "[H", ESCAPE + "OH", ESCAPE + "[1~", "\x01":
+      screen.cursor = 0
+    case ESCAPE + "[F", ESCAPE + "OF", ESCAPE + "[4~", "\x05":
+      screen.cursor = len(screen.input)
+
+    // up and down go through the history
+    case ESCAPE + "[A", ESCAPE + "OA":
+      if (screen.historyIndex > 0) {
+        if (screen.historyIndex == len(screen.history)) {
+          screen.draft = string(screen.input)
+        }
+        screen.historyIndex--
+        screen.setInput(screen.history[screen.historyIndex])
+      }
+    case ESCAPE + "[B", ESCAPE + "OB":
+      if (screen.historyIndex < len(screen.history)) {
+        screen.historyIndex++
+        if (screen.historyIndex == len(screen.history)) {
+          screen.setInput(screen.draft)
+        } else {
+          screen.setInput(screen.history[screen.historyIndex])
+        }
+      }
+
+    // tab completes the input (the choices are shown if there is more than one)
+    case "\t":
+      screen.complete()
+
+    // page up and page down scroll the pane
+    case ESCAPE + "[5~":
+      screen.scroll += screen.paneHeight() - 1
+    case ESCAPE + "[6~":
+      screen.scroll -= screen.paneHeight() - 1
+      if (screen.scroll < 0) {
+        screen.scroll = 0
+      }
+
+    default:
+      r, _ := utf8.DecodeRuneInString(key)
+      if (len(key) == utf8.RuneLen(r) && r >= ' ') {
+        screen.input = append(screen.input[:screen.cursor], append([]rune{r}, screen.input[screen.cursor:]...)...)
+        screen.cursor++
+      }
+  }
+  return "", false, nil
+}
+
+// complete the input before the cursor (screen.lock must be held)
+func (screen *Screen) complete() {
+  if (screen.completer == nil) {
+    return
+  }
+  before := string(screen.input[:screen.cursor])
+  after := string(screen.input[screen.cursor:])
+  choices := screen.completer(before)
+  if (len(choices) == 0) {
+    return
+  }
+
+  // use as much as all of the choices have in common
+  common := []rune(choices[0])
+  for _, choice := range choices[1:] {
+    runes := []rune(choice)
+    i := 0
+    for i < len(common) && i < len(runes) && common[i] == runes[i] {
+      i++
+    }
+    common = common[:i]
+  }
+  if (len(choices) > 1) {
+    start := strings.LastIndex(before, " ") + 1
+    words := []string{}
+    for _, choice := range choices {
+      words = append(words, strings.TrimSpace(choice[start:]))
+    }
+    screen.lines = append(screen.lines, strings.Join(words, "  "))
+  }
+  if (len(common) >= len([]rune(before))) {
+    screen.input = append(common, []rune(after)...)
+    screen.cursor = len(common)
+  }
+}
+
+// replace the input line and put the cursor at the end (screen.lock must be held)
+func (screen *Screen) setInput(value string) {
+  screen.input = []rune(value)
+  screen.cursor = len(screen.input)
+}
+
+// number of rows used by the scrollback pane and sidebar
+func (screen *Screen) paneHeight() int {
+  if (screen.height < 3) {
+    return 1
+  }
+  return screen.height - 2
+}
+
+// draw the screen (screen.lock must be held)
+func (screen *Screen) draw() {
+  if (screen.stopped) {
+    return
+  }
+  sidebarWidth := SIDEBAR_WIDTH
+  if (screen.width - sidebarWidth - 1 < MIN_PANE_WIDTH) {
+    sidebarWidth = 0
+  }
+  paneWidth := screen.width
+  if (sidebarWidth > 0) {
+    paneWidth -= sidebarWidth + 1
+  }
+  height := screen.paneHeight()
+
+  var out strings.Builder
+  out.WriteString(HIDE_CURSOR)
+  rows := screen.paneRows(paneWidth, height)
+  for i := 0; i < height; i++ {
+    fmt.Fprintf(&out, "%s[%d;1H", ESCAPE, i + 1)
+    out.WriteString(pad(rows[i], paneWidth) + RESET)
+    if (sidebarWidth > 0) {
+      sidebarLine := ""
+      if (i < len(screen.sidebar)) {
+        sidebarLine = wrap(screen.sidebar[i], sidebarWidth)[0]
+      }
+      out.WriteString("|" + pad(sidebarLine, sidebarWidth) + RESET)
+    }
+  }
+
+  // the status bar
+  fmt.Fprintf(&out, "%s[%d;1H", ESCAPE, height + 1)
+  status := screen.status
+  if (screen.scroll > 0) {
+    status += " [+" + strconv.Itoa(screen.scroll) + "]"
+  }
+  out.WriteString(REVERSE + pad(wrap(status, screen.width)[0], screen.width) + RESET)
+
+  // the input line (scrolled so the cursor is always visible)
+  inputWidth := screen.width - len(PROMPT) - 1
+  if (inputWidth < 1) {
+    inputWidth = 1
+  }
+  start := 0
+  if (screen.cursor > inputWidth) {
+    start = screen.cursor - inputWidth
+  }
+  end := start + inputWidth
+  if (end > len(screen.input)) {
+    end = len(screen.input)
+  }
+  fmt.Fprintf(&out, "%s[%d;1H%s%s%s", ESCAPE, height + 2, PROMPT, string(screen.input[start:end]), CLEAR_LINE)
+  fmt.Fprintf(&out, "%s[%d;%dH%s", ESCAPE, height + 2, len(PROMPT) + screen.cursor - start + 1, SHOW_CURSOR)
+  os.Stdout.WriteString(out.String())
+}
+
+// return the rows to show in the scrollback pane (wrapping lines to the pane width)
+// only as many lines as needed for the current scroll position are wrapped
+func (screen *Screen) paneRows(width int, height int) []string {
+  rows := []string{}
+  for i := len(screen.lines) - 1; i >= 0 && len(rows) < height + screen.scroll; i-- {
+    rows = append(wrap(screen.lines[i], width), rows...)
+  }
+  if (screen.scroll > len(rows) - height) {
+    // don't scroll past the oldest line
+    screen.scroll = len(rows) - height
+    if (screen.scroll < 0) {
+      screen.scroll = 0
+    }
+  }
+
+  end := len(rows) - screen.scroll
+  start := end - height
+  rtn := make([]string, height)
+  for i := start; i < end; i++ {
+    if (i >= 0) {
+      rtn[i - start] = rows[i]
+    }
+  }
+  return rtn
+}
+
+// split a line into rows of at most width visible characters
+// color escape codes don't use any columns and are carried over to the next row
+func wrap(line string, width int) []string {
+  if (width < 1) {
+    width = 1
+  }
+  rows := []string{}
+  var row strings.Builder
+  active := ""
+  count := 0
+  for i := 0; i < len(line); {
+    if (line[i] == 27) {
+      // copy the whole escape sequence
+      end := i + 1
+      for end < len(line) && !(line[end] >= 0x40 && line[end] <= 0x7e && end > i + 1) {
+        end++
+      }
+      if (end < len(line)) {
+        end++
+      }
+      sequence := line[i:end]
+      if (strings.HasSuffix(sequence, "m")) {
+        active = sequence
+        if (sequence == RESET) {
+          active = ""
+        }
+      }
+      row.WriteString(sequence)
+      i = end
+      continue
+    }
+
+    r, size := utf8.DecodeRuneInString(line[i:])
+    if (r == '\t') {
+      r = ' '
+    }
+    if (count == width) {
+      rows = append(rows, row.String())
+      row.Reset()
+      row.WriteString(active)
+      count = 0
+    }
+    row.WriteRune(r)
+    count++
+    i += size
+  }
+  return append(rows, row.String())
+}
+
+// return true for the C0 and C1 control characters (and DEL) other than tab
+func isControl(r rune) bool {
+  return r != '\t' && (r < 0x20 || (r >= 0x7f && r <= 0x9f))
+}
+
+// remove the control characters (other than tab) from text sent by the server so it can't move the cursor,
+// change the terminal's settings or hide what is shown
+func Sanitize(text string) string {
+  return strings.Map(func(r rune) rune {
+    if (isControl(r)) {
+      return -1
+    }
+    return r
+  }, text)
+}
+
+// remove the control characters from a line before it is drawn
+// only the color escape codes ("\x1b[{numbers}m") the client adds itself are kept
+func clean(line string) string {
+  var out strings.Builder
+  for i := 0; i < len(line); {
+    if (line[i] == 27) {
+      end := i + 1
+      if (end < len(line) && line[end] == '[') {
+        end++
+        for end < len(line) && (line[end] >= '0' && line[end] <= '9' || line[end] == ';') {
+          end++
+        }
+        if (end < len(line) && line[end] == 'm') {
+          out.WriteString(line[i:end + 1])
+          i = end + 1
+          continue
+        }
+      }
+    }
+    r, size := utf8.DecodeRuneInString(line[i:])
+    if (!isControl(r)) {
+      out.WriteRune(r)
+    }
+    i += size
+  }
+  return out.String()
+}
+
+// add spaces to a row so it fills width columns
+func pad(row string, width int) string {
+  count := 0
+  for i := 0; i < len(row); {
+    if (row[i] == 27) {
+      for i < len(row) && !(row[i] >= 0x40 && row[i] <= 0x7e && row[i] != '[') {
+        i++
+      }
+      i++
+      continue
+    }
+    _, size := utf8.DecodeRuneInString(row[i:])
+    count++
+    i += size
+  }
+  if (count >= width) {
+    return row
+  }
+  return row + strings.Repeat(" ", width - count)
+}
+
+// read the terminal size
+func (screen *Screen) updateSize() {
+  screen.lock.Lock()
+  defer screen.lock.Unlock()
+
+  screen.width, screen.height = 80, 24
+  size, err := stty("size")
+  if (err != nil) {
+    return
+  }
+  fields := strings.Fields(size)
+  if (len(fields) == 2) {
+    rows, rowsErr := strconv.Atoi(fields[0])
+    columns, columnsErr := strconv.Atoi(fields[1])
+    if (rowsErr == nil && columnsErr == nil && rows > 0 && columns > 0) {
+      screen.width, screen.height = columns, rows
+    }
+  }
+}
+
+// run stty on the terminal and return its output
+func stty(args ...string) (string, error) {
+  command := exec.Command("stty", args...)
+  command.Stdin = os.Stdin
+  output, err := command.Output()
+  return string(output), err
+}
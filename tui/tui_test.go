@@ -0,0 +1,33 @@
+package tui
+
+import (
+  "testing"
+)
+
+func TestSanitize(t *testing.T) {
+  values := map[string]string{
+    "hello\tthere": "hello\tthere",
+    "evil\x1b[2J\x1b]0;title\x07": "evil[2J]0;title",
+    "back\rspace\x08\x7f": "backspace",
+    "c1\u009b31m": "c131m",
+    "héllo": "héllo",
+  }
+  for value, expected := range values {
+    if actual := Sanitize(value); actual != expected {
+      t.Errorf("Sanitize(%q) = %q, expected %q", value, actual, expected)
+    }
+  }
+}
+
+func TestCleanKeepsColors(t *testing.T) {
+  values := map[string]string{
+    "\x1b[1;33mmention\x1b[0m": "\x1b[1;33mmention\x1b[0m",
+    "\x1b[2Jclear\x1b[?25l": "[2Jclear[?25l",
+    "bell\a": "bell",
+  }
+  for value, expected := range values {
+    if actual := clean(value); actual != expected {
+      t.Errorf("clean(%q) = %q, expected %q", value, actual, expected)
+    }
+  }
+}
@@ -0,0 +1,140 @@
+package util
+
+import (
+  "encoding/json"
+  "fmt"
+  "io/ioutil"
+  "net"
+  "os"
+  "sync"
+)
+
+// banned usernames and IP addresses (saved to the BanFile so they last across restarts)
+type BanList struct {
+  Usernames []string  `json:"usernames"`
+  IPs []string        `json:"ips"`
+}
+
+var bans *BanList
+var bansLock sync.Mutex
+
+// return the ban list (loading it from the BanFile the first time) - bansLock must be held
+func banList() *BanList {
+  if (bans != nil) {
+    return bans
+  }
+  bans = &BanList{Usernames: []string{}, IPs: []string{}}
+
+  path := LoadConfig().BanFile
+  if (path == "") {
+    return bans
+  }
+  payload, err := ioutil.ReadFile(path)
+  if (err != nil) {
+    if (!os.IsNotExist(err)) {
+      Errorf("Can't read ban file %s: %v", path, err)
+    }
+    return bans
+  }
+  err = json.Unmarshal(payload, bans)
+  if (err != nil) {
+    Errorf("Invalid JSON in ban file %s: %v", path, err)
+  }
+  return bans
+}
+
+// save the ban list to the BanFile - bansLock must be held
+func saveBans() error {
+  path := LoadConfig().BanFile
+  if (path == "") {
+    return nil
+  }
+  payload, err := json.MarshalIndent(bans, "", "  ")
+  if (err != nil) {
+    return err
+  }
+  return ioutil.WriteFile(path, payload, 0600)
+}
+
+// return true if the username or IP address has been banned (either value can be empty)
+func IsBanned(username string, ip string) bool {
+  bansLock.Lock()
+  defer bansLock.Unlock()
+
+  list := banList()
+  return (username != "" && containsString(list.Usernames, username)) || (ip != "" && containsString(list.IPs, ip))
+}
+
+// ban a username or an IP address
+func Ban(value string) error {
+  bansLock.Lock()
+  defer bansLock.Unlock()
+
+  list := banList()
+  if (IsIPAddress(value)) {
+    if (!containsString(list.IPs, value)) {
+      list.IPs = append(list.IPs, value)
+    }
+  } else if (!containsString(list.Usernames, value)) {
+    list.Usernames = append(list.Usernames, value)
+  }
+  return saveBans()
+}
+
+// remove the ban for a username or IP address (false is returned if it wasn't banned)
+func Unban(value string) (bool, error) {
+  bansLock.Lock()
+  defer bansLock.Unlock()
+
+  list := banList()
+  usernames := removeValue(list.Usernames, value)
+  ips := removeValue(list.IPs, value)
+  if (len(usernames) == len(list.Usernames) && len(ips) == len(list.IPs)) {
+    return false, nil
+  }
+  list.Usernames = usernames
+  list.IPs = ips
+  return true, saveBans()
+}
+
+// return the values without the one to remove
+func removeValue(values []string, value string) []string {
+  rtn := []string{}
+  for _, v := range values {
+    if (v != value) {
+      rtn = append(rtn, v)
+    }
+  }
+  return rtn
+}
+
+// actions whose content (a banned username or IP address) is only partly shown to other users (the full value is logged)
+var REDACTED_ACTIONS = map[string]bool{"ban": true, "unban": true}
+
+// return the action as it is shown to other users (IP addresses are redacted for the REDACTED_ACTIONS)
+func shownAction(action Action) Action {
+  if (REDACTED_ACTIONS[action.Command]) {
+    action.Content = Encode(RedactIP(Decode(action.Content)))
+  }
+  return action
+}
+
+// return true if the ban value is an IP address rather than a username
+func IsIPAddress(value string) bool {
+  return net.ParseIP(value) != nil
+}
+
+// hide the end of an IP address so it can be shown to other users ("10.0.0.5" -> "10.0.0.x")
+// values that aren't IP addresses are returned as they are
+func RedactIP(value string) string {
+  ip := net.ParseIP(value)
+  if (ip == nil) {
+    return value
+  }
+  if ipv4 := ip.To4(); ipv4 != nil {
+    return fmt.Sprintf("%d.%d.%d.x", ipv4[0], ipv4[1], ipv4[2])
+  }
+  // keep the /48 prefix of IPv6 addresses
+  return fmt.Sprintf("%x:%x:%x::x", uint16(ip[0]) << 8 | uint16(ip[1]), uint16(ip[2]) << 8 | uint16(ip[3]),
+      uint16(ip[4]) << 8 | uint16(ip[5]))
+}
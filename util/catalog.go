@@ -0,0 +1,45 @@
+package util
+
+import (
+  "encoding/json"
+)
+
+// a command the server supports (published to clients after the handshake so they can use commands they
+// don't know about yet)
+type CommandInfo struct {
+  Name string            `json:"name"`
+  Args []ArgInfo         `json:"args,omitempty"`
+  Description string     `json:"description"`
+}
+
+// an argument of a published command
+type ArgInfo struct {
+  Name string            `json:"name"`
+  // "user" or "room" if the argument is a username or room (empty for anything else)
+  Kind string            `json:"kind,omitempty"`
+  // true if the argument can be left out
+  Optional bool          `json:"optional,omitempty"`
+  // true if the argument takes the rest of the line
+  Rest bool              `json:"rest,omitempty"`
+}
+
+// send the command catalog to the client as "/commands {JSON list of commands}"
+// only clients that understand PROTOCOL_VERSION are sent the catalog
+func SendCommandCatalog(catalog []CommandInfo, client *Client) {
+  if (client.Protocol < PROTOCOL_VERSION) {
+    return
+  }
+  payload, err := json.Marshal(catalog)
+  if (err != nil) {
+    Errorf("Can't encode the command catalog: %v", err)
+    return
+  }
+  SendClientResponse("commands", "", Encode(string(payload)), client)
+}
+
+// read the command catalog sent by the server (the "/commands" body after it has been decoded)
+func ParseCommandCatalog(body string) ([]CommandInfo, error) {
+  rtn := []CommandInfo{}
+  err := json.Unmarshal([]byte(body), &rtn)
+  return rtn, err
+}
@@ -0,0 +1,63 @@
+package util
+
+import (
+  "bytes"
+  "reflect"
+  "strings"
+  "testing"
+)
+
+// a connection that keeps what is written to it
+type recordingConn struct {
+  virtualConn
+  written *bytes.Buffer
+}
+
+func (conn recordingConn) Write(data []byte) (int, error) {
+  return conn.written.Write(data)
+}
+
+func TestCommandCatalog(t *testing.T) {
+  catalog := []CommandInfo{
+    {Name: "enter", Args: []ArgInfo{{Name: "room", Kind: "room"}}, Description: "enter a room: any room"},
+    {Name: "msg", Args: []ArgInfo{{Name: "username", Kind: "user"}, {Name: "message", Rest: true}},
+        Description: "send a \"direct\" message, [privately]"},
+    {Name: "history", Args: []ArgInfo{{Name: "count", Optional: true}}, Description: "recent messages"},
+  }
+  tests := []struct {
+    protocol int
+    expected bool
+  }{
+    {1, false},
+    {PROTOCOL_VERSION, true},
+  }
+  for _, test := range tests {
+    written := &bytes.Buffer{}
+    client := &Client{Connection: recordingConn{virtualConn{addr: virtualAddr("test")}, written}, Protocol: test.protocol}
+    SendCommandCatalog(catalog, client)
+    if (!test.expected) {
+      if (written.Len() > 0) {
+        t.Errorf("protocol %d: expected no catalog but got %q", test.protocol, written.String())
+      }
+      continue
+    }
+
+    line := strings.TrimSuffix(written.String(), "\n")
+    body := strings.TrimPrefix(line, "/commands ")
+    if (body == line || strings.ContainsAny(body, "\n[],:\"")) {
+      t.Fatalf("protocol %d: expected one encoded /commands line but got %q", test.protocol, line)
+    }
+    parsed, err := ParseCommandCatalog(Decode(body))
+    if (err != nil || !reflect.DeepEqual(parsed, catalog)) {
+      t.Errorf("protocol %d: expected %+v but got %+v (%v)", test.protocol, catalog, parsed, err)
+    }
+  }
+}
+
+func TestParseInvalidCommandCatalog(t *testing.T) {
+  for _, body := range []string{"", "{", `{"name": "enter"}`, `[{"name": 5}]`} {
+    if _, err := ParseCommandCatalog(body); err == nil {
+      t.Errorf("expected an error for %q", body)
+    }
+  }
+}
@@ -0,0 +1,362 @@
+package util
+
+import (
+  "encoding/json"
+  "flag"
+  "fmt"
+  "io/ioutil"
+  "os"
+  "reflect"
+  "regexp"
+  "strconv"
+  "strings"
+  "sync"
+  "unicode"
+)
+
+// config file used when the "-config" flag isn't provided
+const DEFAULT_CONFIG_FILE = "config.json"
+// prefix of environment variables that override config values (CHAT_PORT, CHAT_LOG_FILE, ...)
+const ENV_PREFIX = "CHAT_"
+
+// general configuration properties
+// values are loaded from the "default" tag, then the config file, then CHAT_* environment
+// variables and finally command line flags (-port, -log-file, ...)
+// values tagged with reload:"restart" are not changed when the config is reloaded
+// values tagged with secret:"true" are never written to the server output
+type Properties struct {
+  // chat server hostname (for client connection)
+  Hostname string                   `json:"Hostname" default:"localhost" reload:"restart"`
+  // chat server port (for server execution and client connection)
+  Port string                       `json:"Port" default:"5555" reload:"restart"`
+  // port used for JSON server
+  JSONEndpointPort string           `json:"JSONEndpointPort" default:"8080" reload:"restart"`
+  // the absolute log file location
+  LogFile string                    `json:"LogFile"`
+  // log file format ("csv" or "jsonl")
+  LogFormat string                  `json:"LogFormat" default:"csv"`
+  // number of seconds between writing buffered log entries to disk
+  LogSyncInterval int               `json:"LogSyncInterval" default:"1"`
+  // rotate the log file when it reaches this many megabytes (0 for no limit)
+  LogMaxSize int                    `json:"LogMaxSize"`
+  // rotate the log file every this many hours (0 for no limit) - hours that divide a day start at midnight UTC
+  LogRotateInterval int             `json:"LogRotateInterval"`
+  // number of rotated log files to keep (0 to keep them all)
+  LogMaxBackups int                 `json:"LogMaxBackups"`
+  // gzip rotated log files
+  LogCompress bool                  `json:"LogCompress"`
+  // load the existing log file when the server starts so it can be queried again
+  LogImport bool                    `json:"LogImport" reload:"restart"`
+  // minimum level of server output ("debug", "info", "warn" or "error")
+  LogLevel string                   `json:"LogLevel" default:"info"`
+  // users that can kick, mute, ban and unban other users and edit or delete any message
+  Moderators []string               `json:"Moderators"`
+  // users that can do everything moderators can and also moderate moderators
+  Admins []string                   `json:"Admins"`
+  // username -> sha256 hex digest of the password admins and moderators must provide with "/auth"
+  // (admins and moderators without a password here are refused their role)
+  RolePasswords map[string]string   `json:"RolePasswords" secret:"true"`
+  // file where banned usernames and IP addresses are saved
+  BanFile string                    `json:"BanFile" default:"bans.json" reload:"restart"`
+  // maximum number of connections to the chat server (0 for no limit)
+  MaxConnections int                `json:"MaxConnections" default:"1000"`
+  // maximum number of connections from a single IP address (0 for no limit)
+  MaxConnectionsPerIP int           `json:"MaxConnectionsPerIP" default:"0"`
+  // number of seconds a new connection has to send "/user" before it is disconnected (0 for no limit)
+  HandshakeTimeout int              `json:"HandshakeTimeout" default:"10"`
+  // number of seconds without anything from a client (including "/pong") before it is disconnected (0 for no limit)
+  // protocol 1 clients (and telnet) don't answer pings so they are disconnected if they are quiet for this long
+  IdleTimeout int                   `json:"IdleTimeout" default:"0"`
+  // number of seconds between "/ping" heartbeats sent to each client (0 to not send them)
+  PingInterval int                  `json:"PingInterval" default:"30"`
+  // number of seconds a lost connection's session can be resumed for before its disconnect is broadcast
+  // (0 to not use sessions)
+  SessionGracePeriod int            `json:"SessionGracePeriod" default:"60"`
+  // number of seconds the client waits before its first attempt to reconnect (0 to exit when the connection is lost)
+  ReconnectDelay int                `json:"ReconnectDelay" default:"1"`
+  // the most seconds the client waits between attempts to reconnect (the delay doubles after each attempt)
+  ReconnectMaxDelay int             `json:"ReconnectMaxDelay" default:"60"`
+  // sustained number of chat messages (messages, edits, replies and reactions) allowed per minute
+  // for each connection and each username (0 for no limit)
+  MessagesPerMinute int             `json:"MessagesPerMinute" default:"30"`
+  // number of chat messages that can be sent at once before MessagesPerMinute applies
+  MessageBurst int                  `json:"MessageBurst" default:"10"`
+  // sustained number of commands of any kind allowed per minute (0 for no limit)
+  CommandsPerMinute int             `json:"CommandsPerMinute" default:"120"`
+  // number of commands that can be sent at once before CommandsPerMinute applies
+  CommandBurst int                  `json:"CommandBurst" default:"30"`
+  // longest chat message allowed in characters (0 for no limit)
+  MaxMessageLength int              `json:"MaxMessageLength" default:"2000"`
+  // number of warnings a flooding user gets before they are muted (they are disconnected if they keep going)
+  FloodWarnings int                 `json:"FloodWarnings" default:"2"`
+  // number of seconds a flooding user is muted for
+  FloodMuteSeconds int              `json:"FloodMuteSeconds" default:"60"`
+  // room -> names of the server plugins enabled in the room ("*" for every room)
+  Plugins map[string][]string       `json:"Plugins"`
+  // words the "profanity" plugin replaces with asterisks
+  ProfanityWords []string           `json:"ProfanityWords"`
+  // outgoing webhooks the actions matching their filters are POSTed to
+  Webhooks []Webhook                `json:"Webhooks" secret:"true"`
+  // number of times a failed webhook delivery is retried
+  WebhookRetries int                `json:"WebhookRetries" default:"5"`
+  // number of seconds before the first webhook retry (the delay doubles after each retry)
+  WebhookRetryDelay int             `json:"WebhookRetryDelay" default:"1"`
+  // number of seconds to wait for a webhook to answer
+  WebhookTimeout int                `json:"WebhookTimeout" default:"10"`
+  // file where webhook deliveries that failed after every retry are written (as JSON lines)
+  WebhookDeadLetterFile string      `json:"WebhookDeadLetterFile" default:"webhooks-failed.jsonl"`
+  // tokens that can post messages to the JSON endpoint's /webhook ("Authorization: Bearer {token}")
+  // the endpoint is turned off if there aren't any
+  IncomingWebhookTokens []string    `json:"IncomingWebhookTokens" secret:"true"`
+  // file where messages for offline users are kept until they are delivered
+  MailboxFile string                `json:"MailboxFile" default:"mailbox.json" reload:"restart"`
+  // client message language (from the environment if not provided)
+  Locale string                     `json:"Locale"`
+  // directory containing the client message catalogs ({locale}.json)
+  LocaleDir string                  `json:"LocaleDir" default:"locales"`
+  // time format (Go layout) shown before each chat event by the client (empty to hide timestamps)
+  TimestampFormat string            `json:"TimestampFormat" default:"15:04"`
+  // client command aliases -> the command line they stand for (like "j": "enter" or "brb": "message be right back")
+  Aliases map[string]string         `json:"Aliases"`
+  // use the full screen terminal UI in the client (scrollback, input line with history, rooms/members sidebar)
+  TUI bool                          `json:"TUI"`
+  // ring the terminal bell when someone mentions the user ("@username")
+  MentionBell bool                  `json:"MentionBell"`
+  // number of seconds between checking the config file for changes (0 to only reload on SIGHUP)
+  ConfigWatchInterval int           `json:"ConfigWatchInterval" default:"2" reload:"restart"`
+}
+
+// cached config properties
+var config = Properties{}
+var isConfigLoaded = false
+// guards the config (which can be replaced while the server is running)
+var configLock sync.RWMutex
+// config file location (set with the "-config" flag)
+var configFile = ""
+// config values provided as command line flags (field name -> value)
+var flagOverrides = map[string]string{}
+
+// register the "-config" flag and a flag for every config value and parse the command line
+// this must be called before LoadConfig for the flags to be used
+func ParseFlags() {
+  flag.StringVar(&configFile, "config", "", "config file location (default \"" + DEFAULT_CONFIG_FILE + "\")")
+
+  propertiesType := reflect.TypeOf(Properties{})
+  for i := 0; i < propertiesType.NumField(); i++ {
+    name := propertiesType.Field(i).Name
+    setOverride := func(value string) error {
+      flagOverrides[name] = value
+      return nil
+    }
+    if (propertiesType.Field(i).Type.Kind() == reflect.Bool) {
+      // boolean flags don't need a value ("-tui" is the same as "-tui=true")
+      flag.BoolFunc(flagName(name), "override the " + name + " config value", setOverride)
+    } else {
+      flag.Func(flagName(name), "override the " + name + " config value", setOverride)
+    }
+  }
+  flag.Parse()
+}
+
+// load the configuration properties (defaults, config file, environment and command line flags)
+// the current values are returned if the config has already been loaded (or reloaded)
+func LoadConfig() Properties {
+  configLock.RLock()
+  if (isConfigLoaded) {
+    defer configLock.RUnlock()
+    return config;
+  }
+  configLock.RUnlock()
+
+  configLock.Lock()
+  defer configLock.Unlock()
+  if (isConfigLoaded) {
+    return config;
+  }
+
+  rtn, err := ReadConfig(configFile)
+  CheckForError(err, "Invalid config")
+
+  SetLogLevel(rtn.LogLevel)
+  config = rtn;
+  isConfigLoaded = true
+  return rtn;
+}
+
+// read and validate the config file (using the default location if file is empty)
+// environment variables and command line flags are applied on top of the file values
+func ReadConfig(file string) (Properties, error) {
+  rtn := Properties{}
+  err := applyDefaults(&rtn)
+  if (err != nil) {
+    return rtn, err
+  }
+
+  path := file
+  if (path == "") {
+    path = DEFAULT_CONFIG_FILE
+  }
+  payload, err := ioutil.ReadFile(path)
+  if (err != nil && !(file == "" && os.IsNotExist(err))) {
+    // the default config file is optional
+    return rtn, fmt.Errorf("unable to read config file: %v", err)
+  }
+
+  if (err == nil) {
+    err = json.Unmarshal(payload, &rtn)
+    if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+      return rtn, fmt.Errorf("%s: expected a %v value in %s", typeErr.Field, typeErr.Type, path)
+    } else if (err != nil) {
+      return rtn, fmt.Errorf("invalid JSON in %s: %v", path, err)
+    }
+  }
+
+  err = applyOverrides(&rtn)
+  if (err != nil) {
+    return rtn, err
+  }
+  return rtn, rtn.Validate()
+}
+
+// make sure the config values make sense
+func (props Properties) Validate() error {
+  for _, name := range []string{"Port", "JSONEndpointPort"} {
+    value := reflect.ValueOf(props).FieldByName(name).String()
+    port, err := strconv.Atoi(value)
+    if (err != nil || port < 1 || port > 65535) {
+      return fmt.Errorf("%s: \"%s\" is not a valid port", name, value)
+    }
+  }
+  if (props.Hostname == "") {
+    return fmt.Errorf("Hostname: must be provided")
+  }
+  if (props.LogFormat != LOG_FORMAT_CSV && props.LogFormat != LOG_FORMAT_JSONL) {
+    return fmt.Errorf("LogFormat: must be \"%s\" or \"%s\"", LOG_FORMAT_CSV, LOG_FORMAT_JSONL)
+  }
+  if (!isLogLevel(props.LogLevel)) {
+    return fmt.Errorf("LogLevel: must be one of %s", strings.Join(LEVEL_NAMES, ", "))
+  }
+
+  for i, hook := range props.Webhooks {
+    if (hook.URL == "") {
+      return fmt.Errorf("Webhooks: webhook %d must have a URL", i + 1)
+    }
+    if _, err := regexp.Compile(hook.Pattern); err != nil {
+      return fmt.Errorf("Webhooks: webhook %d has an invalid Pattern: %v", i + 1, err)
+    }
+  }
+
+  propertiesValue := reflect.ValueOf(props)
+  for i := 0; i < propertiesValue.NumField(); i++ {
+    field := propertiesValue.Field(i)
+    if (field.Kind() == reflect.Int && field.Int() < 0) {
+      return fmt.Errorf("%s: must not be negative", propertiesValue.Type().Field(i).Name)
+    }
+  }
+  return nil
+}
+
+// set the values from the "default" struct tags
+func applyDefaults(props *Properties) error {
+  propertiesType := reflect.TypeOf(*props)
+  for i := 0; i < propertiesType.NumField(); i++ {
+    if value, ok := propertiesType.Field(i).Tag.Lookup("default"); ok {
+      err := setField(props, propertiesType.Field(i).Name, value)
+      if (err != nil) {
+        return err
+      }
+    }
+  }
+  return nil
+}
+
+// set the values from CHAT_* environment variables and then command line flags
+func applyOverrides(props *Properties) error {
+  propertiesType := reflect.TypeOf(*props)
+  for i := 0; i < propertiesType.NumField(); i++ {
+    name := propertiesType.Field(i).Name
+    if value, ok := os.LookupEnv(envName(name)); ok {
+      err := setField(props, name, value)
+      if (err != nil) {
+        return fmt.Errorf("%v (from %s)", err, envName(name))
+      }
+    }
+    if value, ok := flagOverrides[name]; ok {
+      err := setField(props, name, value)
+      if (err != nil) {
+        return fmt.Errorf("%v (from -%s)", err, flagName(name))
+      }
+    }
+  }
+  return nil
+}
+
+// set a config value from its string representation
+// lists are comma separated and anything else that isn't a string, number or boolean is JSON
+func setField(props *Properties, name string, value string) error {
+  field := reflect.ValueOf(props).Elem().FieldByName(name)
+  switch field.Kind() {
+    case reflect.String:
+      field.SetString(value)
+
+    case reflect.Int:
+      number, err := strconv.Atoi(value)
+      if (err != nil) {
+        return fmt.Errorf("%s: \"%s\" is not a number", name, value)
+      }
+      field.SetInt(int64(number))
+
+    case reflect.Bool:
+      flag, err := strconv.ParseBool(value)
+      if (err != nil) {
+        return fmt.Errorf("%s: \"%s\" is not true or false", name, value)
+      }
+      field.SetBool(flag)
+
+    case reflect.Slice:
+      if (field.Type().Elem().Kind() == reflect.String) {
+        values := []string{}
+        for _, item := range strings.Split(value, ",") {
+          if item = strings.TrimSpace(item); item != "" {
+            values = append(values, item)
+          }
+        }
+        field.Set(reflect.ValueOf(values))
+        break
+      }
+      fallthrough
+
+    default:
+      err := json.Unmarshal([]byte(value), field.Addr().Interface())
+      if (err != nil) {
+        return fmt.Errorf("%s: invalid value: %v", name, err)
+      }
+  }
+  return nil
+}
+
+// split a field name into lower case words ("JSONEndpointPort" -> json, endpoint, port)
+func fieldWords(name string) []string {
+  rtn := []string{}
+  runes := []rune(name)
+  start := 0
+  for i := 1; i < len(runes); i++ {
+    isWordStart := unicode.IsUpper(runes[i]) &&
+        (unicode.IsLower(runes[i - 1]) || (i + 1 < len(runes) && unicode.IsLower(runes[i + 1])))
+    if (isWordStart) {
+      rtn = append(rtn, strings.ToLower(string(runes[start:i])))
+      start = i
+    }
+  }
+  return append(rtn, strings.ToLower(string(runes[start:])))
+}
+
+// command line flag for a config value ("JSONEndpointPort" -> "json-endpoint-port")
+func flagName(field string) string {
+  return strings.Join(fieldWords(field), "-")
+}
+
+// environment variable for a config value ("JSONEndpointPort" -> "CHAT_JSON_ENDPOINT_PORT")
+func envName(field string) string {
+  return ENV_PREFIX + strings.ToUpper(strings.Join(fieldWords(field), "_"))
+}
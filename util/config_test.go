@@ -0,0 +1,82 @@
+package util
+
+import (
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+func TestReadConfig(t *testing.T) {
+  tests := []struct {
+    file string
+    env map[string]string
+    // part of the expected error ("" for none)
+    err string
+    check func(props Properties) bool
+  }{
+    {`{}`, nil, "", func(props Properties) bool {
+      return props.Port == "5555" && props.Hostname == "localhost" && props.LogFormat == LOG_FORMAT_CSV
+    }},
+    {`{"Port": "6000"}`, nil, "", func(props Properties) bool {
+      return props.Port == "6000"
+    }},
+    {`{"Port": "6000"}`, map[string]string{"CHAT_PORT": "7000"}, "", func(props Properties) bool {
+      return props.Port == "7000"
+    }},
+    // lists are comma separated and other values are JSON
+    {`{}`, map[string]string{"CHAT_MODERATORS": "mo, al,", "CHAT_ROLE_PASSWORDS": `{"mo": "digest"}`}, "",
+      func(props Properties) bool {
+        return strings.Join(props.Moderators, ",") == "mo,al" && props.RolePasswords["mo"] == "digest"
+      }},
+    {`{"Port": 5555}`, nil, "Port: expected a string value", nil},
+    {`{"Port": "99999"}`, nil, "is not a valid port", nil},
+    {`{"LogFormat": "xml"}`, nil, "LogFormat: must be", nil},
+    {`{"LogLevel": "loud"}`, nil, "LogLevel: must be one of", nil},
+    {`{"IdleTimeout": -1}`, nil, "IdleTimeout: must not be negative", nil},
+    {`{"Webhooks": [{"Pattern": "x"}]}`, nil, "webhook 1 must have a URL", nil},
+    {`{}`, map[string]string{"CHAT_IDLE_TIMEOUT": "soon"}, "(from CHAT_IDLE_TIMEOUT)", nil},
+    {`{"Port": `, nil, "invalid JSON", nil},
+  }
+  for i, test := range tests {
+    path := filepath.Join(t.TempDir(), "config.json")
+    os.WriteFile(path, []byte(test.file), 0600)
+    for name, value := range test.env {
+      t.Setenv(name, value)
+    }
+    props, err := ReadConfig(path)
+    for name := range test.env {
+      os.Unsetenv(name)
+    }
+
+    if (test.err == "" && err != nil) {
+      t.Errorf("test %d: unexpected error %v", i, err)
+    } else if (test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err))) {
+      t.Errorf("test %d: expected an error with %q but got %v", i, test.err, err)
+    } else if (test.check != nil && !test.check(props)) {
+      t.Errorf("test %d: unexpected config %+v", i, props)
+    }
+  }
+}
+
+func TestMissingConfigFile(t *testing.T) {
+  if _, err := ReadConfig(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+    t.Errorf("expected an error for a config file that doesn't exist")
+  }
+}
+
+func TestConfigNames(t *testing.T) {
+  names := map[string][]string{
+    "JSONEndpointPort": {"json-endpoint-port", "CHAT_JSON_ENDPOINT_PORT"},
+    "LogFile": {"log-file", "CHAT_LOG_FILE"},
+    "MaxConnectionsPerIP": {"max-connections-per-ip", "CHAT_MAX_CONNECTIONS_PER_IP"},
+  }
+  for field, expected := range names {
+    if actual := flagName(field); actual != expected[0] {
+      t.Errorf("expected the %s flag to be %q but got %q", field, expected[0], actual)
+    }
+    if actual := envName(field); actual != expected[1] {
+      t.Errorf("expected the %s environment variable to be %q but got %q", field, expected[1], actual)
+    }
+  }
+}
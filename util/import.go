@@ -0,0 +1,271 @@
+package util
+
+import (
+  "bufio"
+  "compress/gzip"
+  "encoding/csv"
+  "encoding/json"
+  "fmt"
+  "io"
+  "os"
+  "path/filepath"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// actions which are logged without content (their content is logged as "N/A")
+var NO_CONTENT_ACTIONS = map[string]bool{"connect": true, "disconnect": true, "delete": true}
+// number of bytes at the end of the log that are read to find the newest action id
+const LOG_TAIL_SIZE = 64 * 1024
+
+// load the actions from an existing audit log so they can be queried again
+// malformed entries are reported and skipped - the number of imported actions is returned
+func ImportLog(path string) (int, error) {
+  file, err := os.Open(path)
+  if (os.IsNotExist(err)) {
+    return 0, nil
+  } else if (err != nil) {
+    return 0, err
+  }
+  defer file.Close()
+
+  reader := bufio.NewReader(file)
+  start, _ := reader.Peek(1)
+  if (len(start) > 0 && start[0] == '{') {
+    return importJSONLines(reader, path)
+  }
+  return importCSV(reader, path)
+}
+
+// import a CSV log - both the current format and the original hand-built format
+// ("joe", "message", "hello ""there""", "{timestamp}", "{ip}") are supported
+// each entry is one line (content never has line breaks) so a malformed entry can't swallow the entries after it
+func importCSV(in io.Reader, path string) (int, error) {
+  scanner := bufio.NewScanner(in)
+  scanner.Buffer(make([]byte, 64 * 1024), 1024 * 1024)
+
+  count := 0
+  line := 0
+  for scanner.Scan() {
+    line++
+    if (strings.TrimSpace(scanner.Text()) == "") {
+      continue
+    }
+    reader := csv.NewReader(strings.NewReader(scanner.Text()))
+    reader.TrimLeadingSpace = true
+    reader.FieldsPerRecord = -1
+    record, err := reader.Read()
+    if (err != nil) {
+      Warnf("Skipping malformed entry in %s line %d: %v", path, line, err)
+      continue
+    }
+
+    if (len(record) > 0 && record[0] == CSV_HEADER[0] && len(record) > 1 && record[1] == CSV_HEADER[1]) {
+      // the header row
+      continue
+    }
+
+    action, err := parseCSVRecord(record)
+    if (err != nil) {
+      Warnf("Skipping malformed entry in %s line %d: %v", path, line, err)
+      continue
+    }
+    addAction(action)
+    count++
+  }
+  return count, scanner.Err()
+}
+
+// convert a CSV log record (username, action, value, timestamp, ip, room, id, target, recipient, source) into an action
+func parseCSVRecord(record []string) (Action, error) {
+  if (len(record) < 5) {
+    return Action{}, fmt.Errorf("expected at least 5 columns but found %d", len(record))
+  }
+  if (record[0] == "" || record[1] == "") {
+    return Action{}, fmt.Errorf("missing username or action")
+  }
+  timestamp := strings.TrimSpace(record[3])
+  if _, err := time.Parse(TIME_LAYOUT, timestamp); err != nil {
+    return Action{}, fmt.Errorf("invalid timestamp \"%s\"", timestamp)
+  }
+
+  rtn := Action{
+    Username: record[0],
+    Command: record[1],
+    Content: record[2],
+    Timestamp: timestamp,
+    IP: record[4],
+  }
+  if (rtn.Content == "N/A" && NO_CONTENT_ACTIONS[rtn.Command]) {
+    // empty values are logged as N/A (a message can really say "N/A")
+    rtn.Content = ""
+  }
+  // entries logged before there were rooms were all in the lobby
+  rtn.Room = LOBBY
+  if (len(record) > 5 && record[5] != "") {
+    rtn.Room = record[5]
+  }
+  if (len(record) > 6) {
+    id, err := strconv.ParseInt(record[6], 10, 64)
+    if (err != nil) {
+      return Action{}, fmt.Errorf("invalid id \"%s\"", record[6])
+    }
+    rtn.ID = id
+  }
+  if (len(record) > 7 && record[7] != "") {
+    target, err := strconv.ParseInt(record[7], 10, 64)
+    if (err != nil) {
+      return Action{}, fmt.Errorf("invalid target \"%s\"", record[7])
+    }
+    rtn.Target = target
+  }
+  if (len(record) > 8) {
+    rtn.Recipient = record[8]
+  }
+  if (len(record) > 9) {
+    rtn.Source = record[9]
+  }
+  return rtn, nil
+}
+
+// import a JSON lines log (one action per line)
+func importJSONLines(in io.Reader, path string) (int, error) {
+  scanner := bufio.NewScanner(in)
+  scanner.Buffer(make([]byte, 64 * 1024), 1024 * 1024)
+
+  count := 0
+  line := 0
+  for scanner.Scan() {
+    line++
+    if (strings.TrimSpace(scanner.Text()) == "") {
+      continue
+    }
+
+    var action Action
+    err := json.Unmarshal(scanner.Bytes(), &action)
+    if (err == nil && (action.Username == "" || action.Command == "")) {
+      err = fmt.Errorf("missing username or command")
+    }
+    if (err == nil) {
+      _, err = time.Parse(TIME_LAYOUT, action.Timestamp)
+    }
+    if (err != nil) {
+      Warnf("Skipping malformed entry in %s line %d: %v", path, line, err)
+      continue
+    }
+    addAction(action)
+    count++
+  }
+  return count, scanner.Err()
+}
+
+// continue the action ids from the newest action in the audit log (or the newest rotated log if the current one
+// has no actions yet) so ids keep increasing across restarts even when the log isn't imported
+func ResumeActionIDs(path string) error {
+  id, err := lastLoggedActionID(path)
+  if (err == nil && id == 0) {
+    id, err = lastRotatedActionID(path)
+  }
+  if (err != nil) {
+    return err
+  }
+
+  actionsLock.Lock()
+  defer actionsLock.Unlock()
+  if (id >= nextActionID) {
+    nextActionID = id + 1
+  }
+  return nil
+}
+
+// return the newest action id in the end of a log file (0 if there isn't one)
+func lastLoggedActionID(path string) (int64, error) {
+  file, err := os.Open(path)
+  if (os.IsNotExist(err)) {
+    return 0, nil
+  } else if (err != nil) {
+    return 0, err
+  }
+  defer file.Close()
+
+  info, err := file.Stat()
+  if (err != nil) {
+    return 0, err
+  }
+  reader := bufio.NewReader(file)
+  if (info.Size() > LOG_TAIL_SIZE) {
+    if _, err := file.Seek(-LOG_TAIL_SIZE, io.SeekEnd); err != nil {
+      return 0, err
+    }
+    // skip the (partial) line we have started in
+    reader.ReadString('\n')
+  }
+  return lastActionID(reader)
+}
+
+// return the newest action id in the newest rotated log (0 if there isn't one)
+func lastRotatedActionID(path string) (int64, error) {
+  matches, _ := filepath.Glob(path + ".*")
+  backups := []string{}
+  for _, match := range matches {
+    suffix := strings.TrimSuffix(match[len(path) + 1:], ".gz")
+    if _, err := time.Parse(ROTATED_LOG_LAYOUT, suffix); err == nil {
+      backups = append(backups, match)
+    }
+  }
+  if (len(backups) == 0) {
+    return 0, nil
+  }
+  // the timestamp suffix sorts oldest first
+  sort.Strings(backups)
+  newest := backups[len(backups) - 1]
+  if (!strings.HasSuffix(newest, ".gz")) {
+    return lastLoggedActionID(newest)
+  }
+
+  file, err := os.Open(newest)
+  if (err != nil) {
+    return 0, err
+  }
+  defer file.Close()
+  reader, err := gzip.NewReader(file)
+  if (err != nil) {
+    return 0, err
+  }
+  defer reader.Close()
+  return lastActionID(reader)
+}
+
+// return the newest action id in CSV or JSON lines log entries (0 if none of them have an id)
+func lastActionID(in io.Reader) (int64, error) {
+  scanner := bufio.NewScanner(in)
+  scanner.Buffer(make([]byte, 64 * 1024), 1024 * 1024)
+
+  rtn := int64(0)
+  for scanner.Scan() {
+    line := strings.TrimSpace(scanner.Text())
+    var action Action
+    if (strings.HasPrefix(line, "{")) {
+      if err := json.Unmarshal([]byte(line), &action); err != nil {
+        continue
+      }
+    } else if (line != "") {
+      reader := csv.NewReader(strings.NewReader(line))
+      reader.TrimLeadingSpace = true
+      reader.FieldsPerRecord = -1
+      record, err := reader.Read()
+      if (err != nil) {
+        continue
+      }
+      if action, err = parseCSVRecord(record); err != nil {
+        continue
+      }
+    }
+    if (action.ID > rtn) {
+      rtn = action.ID
+    }
+  }
+  return rtn, scanner.Err()
+}
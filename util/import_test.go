@@ -0,0 +1,102 @@
+package util
+
+import (
+  "os"
+  "path/filepath"
+  "testing"
+  "time"
+)
+
+// import the log content and return the imported actions by the user
+func importTestLog(t *testing.T, content string, username string) (int, []Action) {
+  path := filepath.Join(t.TempDir(), "chat.log")
+  if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+    t.Fatal(err)
+  }
+  count, err := ImportLog(path)
+  if (err != nil) {
+    t.Fatal(err)
+  }
+  return count, QueryMessages("", "", username)
+}
+
+func TestImportSkipsMalformedRows(t *testing.T) {
+  timestamp := time.Now().Format(TIME_LAYOUT)
+  count, actions := importTestLog(t,
+      "username,action,value,timestamp,ip,room,id,target,recipient,source\n" +
+      "import-malformed,message,\"unterminated," + timestamp + ",127.0.0.1,lobby,9001,,,\n" +
+      "import-malformed,message,hello," + timestamp + ",127.0.0.1,lobby,9002,,,\n" +
+      "import-malformed,message,bad\"quote," + timestamp + ",127.0.0.1,lobby,9003,,,\n" +
+      "import-malformed,message,bye," + timestamp + ",127.0.0.1,lobby,9004,,,\n",
+      "import-malformed")
+
+  if (count != 2 || len(actions) != 2) {
+    t.Fatalf("expected 2 actions but imported %d: %v", count, actions)
+  }
+  if (actions[0].Content != "hello" || actions[1].Content != "bye") {
+    t.Errorf("the malformed rows changed the other actions: %v", actions)
+  }
+}
+
+func TestImportLegacyRows(t *testing.T) {
+  timestamp := time.Now().Format(TIME_LAYOUT)
+  _, actions := importTestLog(t,
+      "import-legacy,message,N/A," + timestamp + ",127.0.0.1\n" +
+      "import-legacy,connect,N/A," + timestamp + ",127.0.0.1\n",
+      "import-legacy")
+
+  if (len(actions) != 2) {
+    t.Fatalf("expected 2 actions but found %v", actions)
+  }
+  if (actions[0].Room != LOBBY) {
+    t.Errorf("expected legacy actions to be in the lobby but found %q", actions[0].Room)
+  }
+  if (actions[0].Content != "N/A") {
+    t.Errorf("expected the message content to be kept but found %q", actions[0].Content)
+  }
+  if (actions[1].Content != "") {
+    t.Errorf("expected the connect content to be empty but found %q", actions[1].Content)
+  }
+}
+
+func TestLastLoggedActionID(t *testing.T) {
+  timestamp := time.Now().Format(TIME_LAYOUT)
+  tests := []struct {
+    content string
+    expected int64
+  }{
+    {"", 0},
+    {"username,action,value,timestamp,ip,room,id,target,recipient,source\n", 0},
+    {"joe,message,hello," + timestamp + ",127.0.0.1,lobby,41,,,\njoe,message,bye," + timestamp + ",127.0.0.1,lobby,42,,,\n", 42},
+    // the original format didn't have ids
+    {"\"joe\", \"message\", \"hello\", \"" + timestamp + "\", \"127.0.0.1\"\n", 0},
+    {`{"id":7,"command":"message","username":"joe"}` + "\n" + `{"id":8,"command":"enter","username":"joe"}` + "\n", 8},
+    // a partly written last line is ignored
+    {"joe,message,hello," + timestamp + ",127.0.0.1,lobby,41,,,\njoe,message,\"cut", 41},
+  }
+  for i, test := range tests {
+    path := filepath.Join(t.TempDir(), "chat.log")
+    os.WriteFile(path, []byte(test.content), 0600)
+    if actual, err := lastLoggedActionID(path); err != nil || actual != test.expected {
+      t.Errorf("test %d: expected %d but got %d (%v)", i, test.expected, actual, err)
+    }
+  }
+}
+
+func TestResumeActionIDsFromRotatedLog(t *testing.T) {
+  timestamp := time.Now().Format(TIME_LAYOUT)
+  path := filepath.Join(t.TempDir(), "chat.log")
+  os.WriteFile(path, []byte("username,action,value,timestamp,ip,room,id,target,recipient,source\n"), 0600)
+  rotated := path + "." + time.Now().Format(ROTATED_LOG_LAYOUT)
+  os.WriteFile(rotated, []byte("joe,message,hello," + timestamp + ",127.0.0.1,lobby,5000000,,,\n"), 0600)
+  if err := compressFile(rotated); err != nil {
+    t.Fatal(err)
+  }
+
+  if err := ResumeActionIDs(path); err != nil {
+    t.Fatal(err)
+  }
+  if action := addAction(Action{Command: "message", Content: "after the restart"}); action.ID <= 5000000 {
+    t.Errorf("expected the ids to carry on from 5000000 but got %d", action.ID)
+  }
+}
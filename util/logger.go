@@ -0,0 +1,74 @@
+package util
+
+import (
+  "log"
+  "os"
+  "strings"
+  "sync/atomic"
+)
+
+// log levels (in order of importance)
+const (
+  LEVEL_DEBUG = iota
+  LEVEL_INFO
+  LEVEL_WARN
+  LEVEL_ERROR
+)
+
+var LEVEL_NAMES = []string{"debug", "info", "warn", "error"}
+
+// current minimum level that will be output (changed when the config is reloaded while other goroutines are logging)
+var logLevel atomic.Int32
+
+func init() {
+  logLevel.Store(LEVEL_INFO)
+}
+// where the server output goes
+var logger = log.New(os.Stdout, "", log.LstdFlags)
+
+// set the minimum level ("debug", "info", "warn" or "error") to be output
+func SetLogLevel(name string) {
+  for level, levelName := range LEVEL_NAMES {
+    if (strings.EqualFold(name, levelName)) {
+      logLevel.Store(int32(level))
+      return
+    }
+  }
+  Warnf("Unknown log level \"%s\"", name)
+}
+
+// return true if the name is a known log level
+func isLogLevel(name string) bool {
+  for _, levelName := range LEVEL_NAMES {
+    if (strings.EqualFold(name, levelName)) {
+      return true
+    }
+  }
+  return false
+}
+
+// output details that are only useful when troubleshooting
+func Debugf(format string, args ...interface{}) {
+  logAt(LEVEL_DEBUG, format, args...)
+}
+
+// output general server activity
+func Infof(format string, args ...interface{}) {
+  logAt(LEVEL_INFO, format, args...)
+}
+
+// output something that is wrong but can be recovered from
+func Warnf(format string, args ...interface{}) {
+  logAt(LEVEL_WARN, format, args...)
+}
+
+// output a failure
+func Errorf(format string, args ...interface{}) {
+  logAt(LEVEL_ERROR, format, args...)
+}
+
+func logAt(level int, format string, args ...interface{}) {
+  if (int32(level) >= logLevel.Load()) {
+    logger.Printf(strings.ToUpper(LEVEL_NAMES[level]) + " " + format, args...)
+  }
+}
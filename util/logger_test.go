@@ -0,0 +1,28 @@
+package util
+
+import (
+  "sync"
+  "testing"
+)
+
+// run with -race: the level is changed by config reloads while other goroutines log
+func TestSetLogLevelWhileLogging(t *testing.T) {
+  defer SetLogLevel("info")
+  var wait sync.WaitGroup
+  wait.Add(1)
+  go func() {
+    defer wait.Done()
+    for i := 0; i < 100; i++ {
+      SetLogLevel(LEVEL_NAMES[LEVEL_WARN + i % 2])
+    }
+  }()
+  for i := 0; i < 100; i++ {
+    Debugf("not shown")
+  }
+  wait.Wait()
+
+  SetLogLevel("ERROR")
+  if (logLevel.Load() != LEVEL_ERROR) {
+    t.Errorf("expected the error level but got %v", logLevel.Load())
+  }
+}
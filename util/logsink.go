@@ -0,0 +1,253 @@
+package util
+
+import (
+  "bufio"
+  "encoding/csv"
+  "encoding/json"
+  "os"
+  "strconv"
+  "sync"
+  "time"
+)
+
+// supported audit log formats
+const LOG_FORMAT_CSV = "csv"
+const LOG_FORMAT_JSONL = "jsonl"
+// columns of the CSV audit log
+var CSV_HEADER = []string{"username", "action", "value", "timestamp", "ip", "room", "id", "target", "recipient", "source"}
+
+// audit log file that is kept open with buffered writes which are periodically synced to disk
+type LogSink struct {
+  lock sync.Mutex
+  // the log file location
+  Path string
+  // "csv" or "jsonl"
+  Format string
+  // when the log file should be rotated
+  Rotation LogRotation
+  file *os.File
+  buffer *bufio.Writer
+  csvWriter *csv.Writer
+  // number of bytes in the current file (not including what is still buffered)
+  size int64
+  // when the current file was created or (for an existing file) last written before we opened it
+  // so the rotation interval isn't reset by restarts or reopening
+  started time.Time
+  done chan bool
+}
+
+// counts the bytes written to the log file so we know when it needs to be rotated
+type countingWriter struct {
+  sink *LogSink
+}
+
+func (writer countingWriter) Write(data []byte) (int, error) {
+  count, err := writer.sink.file.Write(data)
+  writer.sink.size += int64(count)
+  return count, err
+}
+
+// the currently open audit log (if any)
+var sink *LogSink
+var sinkLock sync.Mutex
+
+// open (or create) the audit log and start syncing it every syncInterval
+func OpenLogSink(path string, format string, rotation LogRotation, syncInterval time.Duration) (*LogSink, error) {
+  rtn := &LogSink{Path: path, Format: logFormat(format), Rotation: rotation, done: make(chan bool)}
+  err := rtn.open()
+  if (err != nil) {
+    return nil, err
+  }
+
+  if (syncInterval > 0) {
+    go rtn.syncEvery(syncInterval)
+  }
+  return rtn, nil
+}
+
+// open (or create) the log file - the CSV header is added to new files
+func (sink *LogSink) open() error {
+  file, err := os.OpenFile(sink.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+  if (err != nil) {
+    return err
+  }
+  info, err := file.Stat()
+  if (err != nil) {
+    file.Close()
+    return err
+  }
+
+  sink.file = file
+  sink.size = info.Size()
+  sink.started = time.Now()
+  if (sink.size > 0) {
+    sink.started = info.ModTime()
+  }
+  sink.buffer = bufio.NewWriter(countingWriter{sink})
+  if (sink.Format == LOG_FORMAT_CSV) {
+    sink.csvWriter = csv.NewWriter(sink.buffer)
+    if (sink.size == 0) {
+      sink.csvWriter.Write(CSV_HEADER)
+      sink.csvWriter.Flush()
+    }
+  }
+  return nil
+}
+
+// add an action to the log (it will be written to disk with the next sync)
+func (sink *LogSink) Write(action Action) error {
+  sink.lock.Lock()
+  defer sink.lock.Unlock()
+
+  err := sink.rotateIfNeeded()
+  if (err != nil) {
+    return err
+  }
+
+  if (sink.Format == LOG_FORMAT_JSONL) {
+    payload, err := json.Marshal(action)
+    if (err != nil) {
+      return err
+    }
+    _, err = sink.buffer.Write(append(payload, '\n'))
+    return err
+  }
+
+  value := action.Content
+  if (value == "") {
+    value = "N/A"
+  }
+  target := ""
+  if (action.Target != 0) {
+    target = strconv.FormatInt(action.Target, 10)
+  }
+  sink.csvWriter.Write([]string{action.Username, action.Command, value, action.Timestamp, action.IP, action.Room,
+      strconv.FormatInt(action.ID, 10), target, action.Recipient, action.Source})
+  sink.csvWriter.Flush()
+  return sink.csvWriter.Error()
+}
+
+// write any buffered actions and fsync the file
+func (sink *LogSink) Sync() error {
+  sink.lock.Lock()
+  defer sink.lock.Unlock()
+  return sink.sync()
+}
+
+func (sink *LogSink) sync() error {
+  err := sink.buffer.Flush()
+  if (err != nil) {
+    return err
+  }
+  return sink.file.Sync()
+}
+
+// close the log file and open it again (for when the file has been moved by something like logrotate)
+func (sink *LogSink) Reopen() error {
+  sink.lock.Lock()
+  defer sink.lock.Unlock()
+
+  sink.sync()
+  // the old file is kept (and written to) if the new one can't be opened
+  old := sink.file
+  if err := sink.open(); err != nil {
+    return err
+  }
+  old.Close()
+  return nil
+}
+
+// sync and close the file
+func (sink *LogSink) Close() error {
+  close(sink.done)
+  sink.lock.Lock()
+  defer sink.lock.Unlock()
+
+  err := sink.sync()
+  if closeErr := sink.file.Close(); err == nil {
+    err = closeErr
+  }
+  return err
+}
+
+func (sink *LogSink) syncEvery(interval time.Duration) {
+  ticker := time.NewTicker(interval)
+  defer ticker.Stop()
+  for {
+    select {
+      case <- ticker.C:
+        sink.lock.Lock()
+        err := sink.rotateIfNeeded()
+        if (err == nil) {
+          err = sink.sync()
+        }
+        sink.lock.Unlock()
+        if (err != nil) {
+          Errorf("Can't sync log file %s: %v", sink.Path, err)
+        }
+      case <- sink.done:
+        return
+    }
+  }
+}
+
+// write an action to the audit log for the config properties (opening it if the location or format has changed)
+// the write happens while holding sinkLock so the log can't be closed or replaced part way through
+func writeLog(action Action, props Properties) error {
+  sinkLock.Lock()
+  defer sinkLock.Unlock()
+
+  if (sink != nil && (sink.Path != props.LogFile || sink.Format != logFormat(props.LogFormat))) {
+    if err := sink.Close(); err != nil {
+      Errorf("Can't close log file %s: %v", sink.Path, err)
+    }
+    sink = nil
+  }
+  if (sink == nil) {
+    opened, err := OpenLogSink(props.LogFile, props.LogFormat, logRotation(props),
+        time.Duration(props.LogSyncInterval) * time.Second)
+    if (err != nil) {
+      return err
+    }
+    sink = opened
+  } else {
+    sink.lock.Lock()
+    sink.Rotation = logRotation(props)
+    sink.lock.Unlock()
+  }
+  return sink.Write(action)
+}
+
+// return the log format to use for the configured format (csv unless jsonl)
+func logFormat(format string) string {
+  if (format == LOG_FORMAT_JSONL) {
+    return LOG_FORMAT_JSONL
+  }
+  return LOG_FORMAT_CSV
+}
+
+// close and reopen the audit log (if it is open)
+func ReopenLog() {
+  sinkLock.Lock()
+  defer sinkLock.Unlock()
+
+  if (sink != nil) {
+    Infof("Reopening log file %s", sink.Path)
+    if err := sink.Reopen(); err != nil {
+      Errorf("Can't reopen log file %s (still writing to the old one): %v", sink.Path, err)
+    }
+  }
+}
+
+// flush and close the audit log (if it is open)
+func CloseLog() {
+  sinkLock.Lock()
+  defer sinkLock.Unlock()
+
+  if (sink != nil) {
+    if err := sink.Close(); err != nil {
+      Errorf("Can't close log file %s: %v", sink.Path, err)
+    }
+    sink = nil
+  }
+}
@@ -0,0 +1,140 @@
+package util
+
+import (
+  "encoding/json"
+  "io/ioutil"
+  "os"
+  "sync"
+)
+
+// most messages kept for a user (the oldest are dropped)
+const MAILBOX_LIMIT = 100
+
+// a message waiting in a user's mailbox
+type Mail struct {
+  Action
+  // true once the message has been delivered
+  Read bool             `json:"read"`
+}
+
+// users that have connected and the messages waiting for them (saved to the MailboxFile so they last across restarts)
+type Mailboxes struct {
+  Users []string          `json:"users"`
+  Messages map[string][]Mail  `json:"messages"`
+}
+
+var mailboxes *Mailboxes
+var mailboxesLock sync.Mutex
+
+// return the mailboxes (loading them from the MailboxFile the first time) - mailboxesLock must be held
+func mailboxList() *Mailboxes {
+  if (mailboxes != nil) {
+    return mailboxes
+  }
+  mailboxes = &Mailboxes{Users: []string{}, Messages: map[string][]Mail{}}
+
+  path := LoadConfig().MailboxFile
+  if (path == "") {
+    return mailboxes
+  }
+  payload, err := ioutil.ReadFile(path)
+  if (err != nil) {
+    if (!os.IsNotExist(err)) {
+      Errorf("Can't read mailbox file %s: %v", path, err)
+    }
+    return mailboxes
+  }
+  err = json.Unmarshal(payload, mailboxes)
+  if (err != nil) {
+    Errorf("Invalid JSON in mailbox file %s: %v", path, err)
+  }
+  if (mailboxes.Messages == nil) {
+    mailboxes.Messages = map[string][]Mail{}
+  }
+  return mailboxes
+}
+
+// save the mailboxes to the MailboxFile - mailboxesLock must be held
+func saveMailboxes() {
+  path := LoadConfig().MailboxFile
+  if (path == "") {
+    return
+  }
+  payload, err := json.MarshalIndent(mailboxes, "", "  ")
+  if (err == nil) {
+    err = ioutil.WriteFile(path, payload, 0600)
+  }
+  if (err != nil) {
+    Errorf("Can't save mailbox file %s: %v", path, err)
+  }
+}
+
+// remember that the user has connected (so messages can be left for them when they are offline)
+func RememberUser(username string) {
+  mailboxesLock.Lock()
+  defer mailboxesLock.Unlock()
+
+  list := mailboxList()
+  if (!containsString(list.Users, username)) {
+    list.Users = append(list.Users, username)
+    saveMailboxes()
+  }
+}
+
+// return true if the user has connected before
+func IsKnownUser(username string) bool {
+  mailboxesLock.Lock()
+  defer mailboxesLock.Unlock()
+  return containsString(mailboxList().Users, username)
+}
+
+// leave a message for an offline user
+func QueueMail(username string, action Action) {
+  mailboxesLock.Lock()
+  defer mailboxesLock.Unlock()
+
+  list := mailboxList()
+  messages := append(list.Messages[username], Mail{Action: action})
+  if (len(messages) > MAILBOX_LIMIT) {
+    messages = messages[len(messages) - MAILBOX_LIMIT:]
+  }
+  list.Messages[username] = messages
+  saveMailboxes()
+}
+
+// return the messages in the user's mailbox - if unreadOnly is true only the messages that haven't been
+// delivered are returned (and they are marked as read)
+func ReadMail(username string, unreadOnly bool) []Mail {
+  mailboxesLock.Lock()
+  defer mailboxesLock.Unlock()
+
+  rtn := []Mail{}
+  messages := mailboxList().Messages[username]
+  changed := false
+  for i := range messages {
+    if (unreadOnly && messages[i].Read) {
+      continue
+    }
+    rtn = append(rtn, messages[i])
+    if (!messages[i].Read) {
+      messages[i].Read = true
+      changed = true
+    }
+  }
+  if (changed) {
+    saveMailboxes()
+  }
+  return rtn
+}
+
+// remove all of the messages from the user's mailbox
+func ClearMail(username string) {
+  mailboxesLock.Lock()
+  defer mailboxesLock.Unlock()
+
+  list := mailboxList()
+  if _, ok := list.Messages[username]; ok {
+    delete(list.Messages, username)
+    saveMailboxes()
+  }
+}
@@ -0,0 +1,71 @@
+package util
+
+import (
+  "net/url"
+  "regexp"
+  "strings"
+)
+
+// "@username" in a message (but not an email address like joe@example.com)
+var MENTION_PATTERN = regexp.MustCompile(`(?:^|[^\w@])@([\w\-]+)`)
+
+// return the usernames mentioned in a message (each only once)
+func ParseMentions(content string) []string {
+  rtn := []string{}
+  for _, match := range MENTION_PATTERN.FindAllStringSubmatch(Decode(content), -1) {
+    if (!containsString(rtn, match[1])) {
+      rtn = append(rtn, match[1])
+    }
+  }
+  return rtn
+}
+
+// return true if the message mentions the user
+func IsMentioned(content string, username string) bool {
+  return username != "" && containsString(ParseMentions(content), username)
+}
+
+// return the "{room} {message}" body of a mention event for a room and (encoded) message
+// the room is escaped so a room name with spaces can't be mistaken for the start of the message
+func MentionBody(room string, content string) string {
+  return Encode(url.PathEscape(Decode(room))) + " " + content
+}
+
+// return the room and message of a (decoded) mention event body
+func ParseMentionBody(body string) (string, string) {
+  parts := strings.SplitN(body, " ", 2)
+  text := ""
+  if (len(parts) == 2) {
+    text = parts[1]
+  }
+  room, err := url.PathUnescape(parts[0])
+  if (err != nil) {
+    return parts[0], text
+  }
+  return room, text
+}
+
+// send a "mention" event to the users mentioned in a message (wherever they are)
+// as "/mention [{username}] {{id} {time}} {room} {message}" - the message is left in the mailbox of mentioned users
+// that have connected before but aren't connected now
+func NotifyMentions(action Action, client *Client) {
+  mention := action
+  mention.Command = "mention"
+  mention.Content = MentionBody(action.Room, action.Content)
+  mention.Target = 0
+
+  for _, username := range ParseMentions(action.Content) {
+    if (username == client.Username) {
+      continue
+    }
+    targets := FindClients(username)
+    if (len(targets) == 0 && IsKnownUser(username)) {
+      QueueMail(username, action)
+    }
+    for _, target := range targets {
+      if (!target.IsIgnoring(client.Username)) {
+        SendClientAction("mention", mention, target)
+      }
+    }
+  }
+}
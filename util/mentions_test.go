@@ -0,0 +1,38 @@
+package util
+
+import (
+  "testing"
+)
+
+func TestMentionBodyKeepsTheRoom(t *testing.T) {
+  rooms := []string{LOBBY, "ops", "war room", "50% off", "a%20b", Encode("team: red")}
+  for _, room := range rooms {
+    body := MentionBody(room, Encode("hi @ann, see [this]"))
+    // the client decodes the whole body before splitting it
+    actualRoom, actualText := ParseMentionBody(Decode(body))
+    if (actualRoom != Decode(room) || actualText != "hi @ann, see [this]") {
+      t.Errorf("expected %q and the message for the room %q but got %q and %q", Decode(room), room, actualRoom, actualText)
+    }
+  }
+}
+
+func TestParseMentions(t *testing.T) {
+  tests := map[string][]string{
+    "hi @ann and @bob-2": {"ann", "bob-2"},
+    "@ann @ann": {"ann"},
+    "mail joe@example.com": {},
+    Encode("@ann: look"): {"ann"},
+  }
+  for content, expected := range tests {
+    actual := ParseMentions(content)
+    if (len(actual) != len(expected)) {
+      t.Errorf("expected %v in %q but got %v", expected, content, actual)
+      continue
+    }
+    for i := range expected {
+      if (actual[i] != expected[i]) {
+        t.Errorf("expected %v in %q but got %v", expected, content, actual)
+      }
+    }
+  }
+}
@@ -0,0 +1,174 @@
+package util
+
+// a previous version of an edited message
+type Revision struct {
+  // the message content before it was changed
+  Content string        `json:"content"`
+  // the user that changed it
+  Username string       `json:"username"`
+  // when it was changed
+  Timestamp string      `json:"timestamp"`
+}
+
+// a chat message with its current content and the edits that have been made to it
+type Message struct {
+  Action
+  // true if the message has been deleted
+  Deleted bool          `json:"deleted,omitempty"`
+  // the previous versions of the message (oldest first)
+  History []Revision    `json:"history,omitempty"`
+  // reaction (emoji) -> number of users that reacted with it
+  Reactions map[string]int  `json:"reactions,omitempty"`
+  // number of (non deleted) replies to the message
+  ReplyCount int        `json:"replyCount,omitempty"`
+}
+
+// a message and all of the replies to it (and their replies)
+type Thread struct {
+  Message
+  Replies []Thread      `json:"replies"`
+}
+
+// message id -> index of the "message" action (guarded by actionsLock)
+var messageDocs = map[int64]int{}
+// message id -> indexes of the "edit", "delete", "react" and reply actions for the message (guarded by actionsLock)
+var revisionDocs = map[int64][]int{}
+
+// keep track of messages and the edits/deletes/reactions/replies made to them (actionsLock must be held)
+// if the action changes a message, the index and previous content of the message are returned
+func trackMessage(doc int, action Action) (int, string) {
+  if (action.Command == "message") {
+    messageDocs[action.ID] = doc
+  }
+  if (action.Target == 0) {
+    return -1, ""
+  }
+
+  messageDoc, ok := messageDocs[action.Target]
+  if (!ok) {
+    return -1, ""
+  }
+  previous := messageView(actions[messageDoc])
+  revisionDocs[action.Target] = append(revisionDocs[action.Target], doc)
+  if (previous.Deleted || (action.Command != "edit" && action.Command != "delete")) {
+    // replies and reactions don't change the content (and deleted messages aren't in the search index)
+    return -1, ""
+  }
+  return messageDoc, previous.Content
+}
+
+// build the current version of a message (actionsLock must be held)
+func messageView(action Action) Message {
+  rtn := Message{Action: action}
+  for _, doc := range revisionDocs[action.ID] {
+    revision := actions[doc]
+    switch revision.Command {
+      case "edit":
+        rtn.History = append(rtn.History, Revision{
+          Content: rtn.Content,
+          Username: revision.Username,
+          Timestamp: revision.Timestamp,
+        })
+        rtn.Content = revision.Content
+      case "delete":
+        rtn.Deleted = true
+      case "react":
+        if (rtn.Reactions == nil) {
+          rtn.Reactions = map[string]int{}
+        }
+        rtn.Reactions[revision.Content]++
+      case "message":
+        // a reply
+        if (!messageView(revision).Deleted) {
+          rtn.ReplyCount++
+        }
+    }
+  }
+  return rtn
+}
+
+// return true if the user has already reacted to the message with the reaction
+func HasReacted(id int64, username string, reaction string) bool {
+  actionsLock.RLock()
+  defer actionsLock.RUnlock()
+
+  for _, doc := range revisionDocs[id] {
+    revision := actions[doc]
+    if (revision.Command == "react" && revision.Username == username && revision.Content == reaction) {
+      return true
+    }
+  }
+  return false
+}
+
+// return the message with all of its (non deleted) replies
+func FindThread(id int64) (Thread, bool) {
+  actionsLock.RLock()
+  defer actionsLock.RUnlock()
+
+  doc, ok := messageDocs[id]
+  if (!ok) {
+    return Thread{}, false
+  }
+  view := messageView(actions[doc])
+  if (view.Deleted) {
+    return Thread{}, false
+  }
+  return thread(view), true
+}
+
+// build the reply tree for a message (actionsLock must be held)
+func thread(message Message) Thread {
+  rtn := Thread{Message: message, Replies: []Thread{}}
+  for _, doc := range revisionDocs[message.ID] {
+    if (actions[doc].Command != "message") {
+      continue
+    }
+    if reply := messageView(actions[doc]); !reply.Deleted {
+      rtn.Replies = append(rtn.Replies, thread(reply))
+    }
+  }
+  return rtn
+}
+
+// return the action with the current content if it is an edited message (actionsLock must be held)
+// false is returned if the message has been deleted
+func currentMessage(action Action) (Action, bool) {
+  if (action.Command != "message") {
+    return action, true
+  }
+  view := messageView(action)
+  return view.Action, !view.Deleted
+}
+
+// return the current version of a message
+func FindMessage(id int64) (Message, bool) {
+  actionsLock.RLock()
+  defer actionsLock.RUnlock()
+
+  doc, ok := messageDocs[id]
+  if (!ok) {
+    return Message{}, false
+  }
+  return messageView(actions[doc]), true
+}
+
+// return the current version of the messages (with their edit history)
+// deleted messages are not included and any action that isn't a message is returned as is
+func MessageViews(list []Action) []Message {
+  actionsLock.RLock()
+  defer actionsLock.RUnlock()
+
+  rtn := make([]Message, 0, len(list))
+  for _, action := range list {
+    if (action.Command != "message") {
+      rtn = append(rtn, Message{Action: action})
+      continue
+    }
+    view := messageView(action)
+    if (!view.Deleted) {
+      rtn = append(rtn, view)
+    }
+  }
+  return rtn
+}
@@ -0,0 +1,57 @@
+package util
+
+import (
+  "testing"
+)
+
+func TestMessageViews(t *testing.T) {
+  message := addAction(Action{Command: "message", Username: "ann", Content: "hello", Room: "views"})
+  reply := addAction(Action{Command: "message", Username: "bob", Content: "hi", Target: message.ID, Room: "views"})
+  tests := []struct {
+    action Action
+    check func(view Message, thread Thread) bool
+  }{
+    {Action{Command: "react", Username: "bob", Content: "+1"}, func(view Message, thread Thread) bool {
+      return view.Reactions["+1"] == 1 && view.ReplyCount == 1 && len(thread.Replies) == 1
+    }},
+    {Action{Command: "react", Username: "cat", Content: "+1"}, func(view Message, thread Thread) bool {
+      return view.Reactions["+1"] == 2
+    }},
+    {Action{Command: "edit", Username: "ann", Content: "hello there"}, func(view Message, thread Thread) bool {
+      return view.Content == "hello there" && len(view.History) == 1 && view.History[0].Content == "hello"
+    }},
+    {Action{Command: "message", Username: "cat", Content: "me too"}, func(view Message, thread Thread) bool {
+      return view.ReplyCount == 2 && len(thread.Replies) == 2 && thread.Replies[1].Content == "me too"
+    }},
+    // replies to replies are part of the thread but only count for their parent
+    {Action{Command: "message", Username: "ann", Content: "nested", Target: reply.ID}, func(view Message, thread Thread) bool {
+      return view.ReplyCount == 2 && len(thread.Replies[0].Replies) == 1
+    }},
+    {Action{Command: "delete", Username: "bob", Target: reply.ID}, func(view Message, thread Thread) bool {
+      return view.ReplyCount == 1 && len(thread.Replies) == 1
+    }},
+  }
+  for i, test := range tests {
+    if (test.action.Target == 0) {
+      test.action.Target = message.ID
+    }
+    test.action.Room = "views"
+    addAction(test.action)
+    view, _ := FindMessage(message.ID)
+    thread, _ := FindThread(message.ID)
+    if (!test.check(view, thread)) {
+      t.Errorf("test %d (%s): unexpected message %+v", i, test.action.Command, view)
+    }
+  }
+
+  if (!HasReacted(message.ID, "bob", "+1") || HasReacted(message.ID, "ann", "+1")) {
+    t.Errorf("expected only bob and cat to have reacted")
+  }
+  addAction(Action{Command: "delete", Username: "ann", Target: message.ID, Room: "views"})
+  if _, ok := FindThread(message.ID); ok {
+    t.Errorf("expected a deleted message not to have a thread")
+  }
+  if views := MessageViews([]Action{message}); len(views) != 0 {
+    t.Errorf("expected a deleted message to be left out but got %v", views)
+  }
+}
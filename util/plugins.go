@@ -0,0 +1,143 @@
+package util
+
+import (
+  "sync"
+)
+
+// commands that are always carried out, logged and broadcast - PreHandle isn't called for them
+// and PreBroadcast can see their actions but can't change or reject them
+var MODERATION_COMMANDS = map[string]bool{"auth": true, "kick": true, "mute": true, "ban": true, "unban": true}
+
+// a server plugin which can inspect, rewrite or reject commands and actions
+// plugins are registered in Go (RegisterPlugin) and enabled for rooms with the Plugins config value
+// any of the hooks can be left out
+type Plugin struct {
+  // the name used in the Plugins config value
+  Name string
+  // called before the server handles a command from a client (other than the MODERATION_COMMANDS)
+  // the command and body can be rewritten, Handled can be set if the plugin has answered the command itself
+  // and returning an error rejects the command
+  PreHandle func(event *Event, props Properties) error
+  // called before every action is logged and sent to clients
+  // the action and recipients can be rewritten and returning an error rejects the action (other than for the
+  // MODERATION_COMMANDS)
+  PreBroadcast func(event *Event, props Properties) error
+  // called after an action has been logged (the event can't be changed)
+  PostLog func(event *Event, props Properties)
+}
+
+// what plugin hooks are called with
+type Event struct {
+  // the client that sent the command or performed the action
+  Client *Client
+  // the room the command or action is for
+  Room string
+  // the command and its content ("message", "hello") - PreHandle only
+  Command string
+  Body string
+  // true if a plugin has handled the command (the server won't) - PreHandle only
+  Handled bool
+  // the action being sent or that has been logged - PreBroadcast and PostLog only
+  Action Action
+  // the clients the action will be sent to - PreBroadcast only
+  Recipients []*Client
+}
+
+// name -> registered plugin
+var plugins = map[string]*Plugin{}
+var pluginsLock sync.RWMutex
+
+// make a plugin available to be enabled with the Plugins config value (replacing any plugin with the same name)
+func RegisterPlugin(plugin Plugin) {
+  pluginsLock.Lock()
+  defer pluginsLock.Unlock()
+  plugins[plugin.Name] = &plugin
+}
+
+// return the plugin names in the config that haven't been registered
+func UnknownPlugins(props Properties) []string {
+  pluginsLock.RLock()
+  defer pluginsLock.RUnlock()
+  rtn := []string{}
+  for _, names := range props.Plugins {
+    for _, name := range names {
+      if _, ok := plugins[name]; !ok && !containsString(rtn, name) {
+        rtn = append(rtn, name)
+      }
+    }
+  }
+  return rtn
+}
+
+// return the plugins enabled for the room (the "*" plugins first)
+func roomPlugins(room string, props Properties) []*Plugin {
+  pluginsLock.RLock()
+  defer pluginsLock.RUnlock()
+  rtn := []*Plugin{}
+  names := []string{}
+  for _, name := range append(append([]string{}, props.Plugins["*"]...), props.Plugins[room]...) {
+    if plugin, ok := plugins[name]; ok && !containsString(names, name) {
+      names = append(names, name)
+      rtn = append(rtn, plugin)
+    }
+  }
+  return rtn
+}
+
+// run the PreHandle hooks for a command from the client
+// the (possibly rewritten) command and body are returned with false if the server shouldn't handle the command
+// (a plugin has handled it or rejected it - the client is sent "/error rejected {reason}" for rejections)
+func PreHandle(client *Client, command string, body string, props Properties) (string, string, bool) {
+  if (MODERATION_COMMANDS[command]) {
+    return command, body, true
+  }
+  event := Event{Client: client, Room: client.Room, Command: command, Body: body}
+  for _, plugin := range roomPlugins(client.Room, props) {
+    if (plugin.PreHandle == nil) {
+      continue
+    }
+    if err := plugin.PreHandle(&event, props); err != nil {
+      Debugf("Plugin %s rejected %s from %s: %v", plugin.Name, command, client.Username, err)
+      SendClientResponse("error", "", "rejected " + err.Error(), client)
+      return event.Command, event.Body, false
+    }
+    if (event.Handled) {
+      return event.Command, event.Body, false
+    }
+  }
+  return event.Command, event.Body, true
+}
+
+// run the PreBroadcast hooks for an action by the client (the action room must be set)
+// the (possibly rewritten) action and recipients are returned with false if a plugin rejected the action
+// (the client is sent "/error rejected {reason}") - moderation actions are always returned as they are
+func PreBroadcast(action Action, recipients []*Client, client *Client, props Properties) (Action, []*Client, bool) {
+  isModeration := MODERATION_COMMANDS[action.Command]
+  event := Event{Client: client, Room: action.Room, Action: action, Recipients: recipients}
+  for _, plugin := range roomPlugins(action.Room, props) {
+    if (plugin.PreBroadcast == nil) {
+      continue
+    }
+    err := plugin.PreBroadcast(&event, props)
+    if (err != nil && isModeration) {
+      Warnf("Plugin %s can't reject %s from %s: %v", plugin.Name, action.Command, client.Username, err)
+    } else if (err != nil) {
+      Debugf("Plugin %s rejected %s from %s: %v", plugin.Name, action.Command, client.Username, err)
+      SendClientResponse("error", "", "rejected " + err.Error(), client)
+      return event.Action, event.Recipients, false
+    }
+  }
+  if (isModeration) {
+    return action, recipients, true
+  }
+  return event.Action, event.Recipients, true
+}
+
+// run the PostLog hooks for an action that has been logged
+func postLog(action Action, client *Client, props Properties) {
+  for _, plugin := range roomPlugins(action.Room, props) {
+    if (plugin.PostLog != nil) {
+      plugin.PostLog(&Event{Client: client, Room: action.Room, Action: action}, props)
+    }
+  }
+}
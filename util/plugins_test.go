@@ -0,0 +1,45 @@
+package util
+
+import (
+  "errors"
+  "strings"
+  "testing"
+)
+
+func TestPluginsCantStopModeration(t *testing.T) {
+  loadTestConfig(t, `{"Plugins": {"*": ["reject"]}}`)
+  seen := []string{}
+  RegisterPlugin(Plugin{Name: "reject",
+    PreHandle: func(event *Event, props Properties) error {
+      return errors.New("no")
+    },
+    PreBroadcast: func(event *Event, props Properties) error {
+      seen = append(seen, event.Action.Command)
+      event.Action.Content = "rewritten"
+      event.Recipients = nil
+      return errors.New("no")
+    },
+  })
+  defer RegisterPlugin(Plugin{Name: "reject"})
+  props := LoadConfig()
+  client := &Client{Connection: virtualConn{addr: virtualAddr("test")}, Username: "mo", Room: LOBBY}
+
+  for _, command := range []string{"kick", "mute", "ban", "unban"} {
+    if _, _, ok := PreHandle(client, command, "joe", props); !ok {
+      t.Errorf("expected %s to be handled", command)
+    }
+    if action, ok := BroadcastAction(Action{Command: command, Content: "joe"}, client, props); !ok || action.Content != "joe" {
+      t.Errorf("expected %s to be broadcast as it is but got %v", command, action)
+    }
+  }
+  for _, command := range []string{"message", "enter", "leave"} {
+    if _, ok := BroadcastAction(Action{Command: command, Content: "hello"}, client, props); ok {
+      t.Errorf("expected %s to be rejected", command)
+    }
+  }
+
+  expected := []string{"kick", "mute", "ban", "unban", "message", "enter", "leave"}
+  if (strings.Join(seen, ",") != strings.Join(expected, ",")) {
+    t.Errorf("expected the plugin to see %v but it saw %v", expected, seen)
+  }
+}
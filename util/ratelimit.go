@@ -0,0 +1,148 @@
+package util
+
+import (
+  "sync"
+  "time"
+)
+
+// what should happen to a client after CheckRate
+const (
+  // the command can be handled
+  RATE_OK = iota
+  // the command is dropped (the client has just been warned or muted so it doesn't count as another warning)
+  RATE_DROP
+  // the command is dropped and the client is warned
+  RATE_WARN
+  // the command is dropped and the user is muted
+  RATE_MUTE
+  // the command is dropped and the client is disconnected
+  RATE_DISCONNECT
+  // the message is longer than MaxMessageLength and is dropped (this isn't flooding)
+  RATE_TOO_LONG
+)
+
+// breaking the limits again within this long of a warning only drops the command
+const FLOOD_STRIKE_INTERVAL = 5 * time.Second
+// a flooding user's warnings are forgotten after this long without breaking the limits
+const FLOOD_STRIKE_RESET = 5 * time.Minute
+// username limiters that haven't been used for this long are removed
+const LIMITER_IDLE_TIMEOUT = 10 * time.Minute
+
+// allows a burst of events and then a sustained number of events per minute
+type tokenBucket struct {
+  tokens float64
+  last time.Time
+}
+
+// the limits for a connection or username
+type rateLimiter struct {
+  messages tokenBucket
+  commands tokenBucket
+  // number of times the limits have been broken recently
+  strikes int
+  lastStrike time.Time
+  lastUsed time.Time
+}
+
+// username -> rate limits shared by all of the user's connections
+var userLimiters = map[string]*rateLimiter{}
+// guards userLimiters and the connection limiters
+var limitersLock sync.Mutex
+
+// take a token from the bucket - false is returned if there are none left
+// a perMinute of 0 means there is no limit
+func (bucket *tokenBucket) take(perMinute int, burst int, now time.Time) bool {
+  if (perMinute <= 0) {
+    return true
+  }
+  if (burst < 1) {
+    burst = 1
+  }
+  if (bucket.last.IsZero()) {
+    bucket.tokens = float64(burst)
+  } else {
+    bucket.tokens += now.Sub(bucket.last).Minutes() * float64(perMinute)
+    if (bucket.tokens > float64(burst)) {
+      bucket.tokens = float64(burst)
+    }
+  }
+  bucket.last = now
+
+  if (bucket.tokens < 1) {
+    return false
+  }
+  bucket.tokens--
+  return true
+}
+
+// take tokens for the command - false is returned if the limits have been reached
+func (limiter *rateLimiter) allow(isMessage bool, props Properties, now time.Time) bool {
+  limiter.lastUsed = now
+  allowed := limiter.commands.take(props.CommandsPerMinute, props.CommandBurst, now)
+  if (isMessage) {
+    allowed = limiter.messages.take(props.MessagesPerMinute, props.MessageBurst, now) && allowed
+  }
+  return allowed
+}
+
+// record that the limits have been broken and decide what to do about it
+func (limiter *rateLimiter) strike(props Properties, now time.Time) int {
+  if (limiter.strikes > 0 && now.Sub(limiter.lastStrike) < FLOOD_STRIKE_INTERVAL) {
+    return RATE_DROP
+  }
+  if (now.Sub(limiter.lastStrike) > FLOOD_STRIKE_RESET) {
+    limiter.strikes = 0
+  }
+  limiter.strikes++
+  limiter.lastStrike = now
+
+  if (limiter.strikes <= props.FloodWarnings) {
+    return RATE_WARN
+  } else if (limiter.strikes == props.FloodWarnings + 1 && props.FloodMuteSeconds > 0) {
+    return RATE_MUTE
+  }
+  return RATE_DISCONNECT
+}
+
+// check the client's command against the rate and message length limits (for the connection and username)
+// isMessage is true for commands that produce chat messages and length is the number of characters sent
+// the result is RATE_OK, RATE_TOO_LONG or what should happen to the client because it is flooding
+func (client *Client) CheckRate(isMessage bool, length int, props Properties) int {
+  if (isMessage && props.MaxMessageLength > 0 && length > props.MaxMessageLength) {
+    return RATE_TOO_LONG
+  }
+  limitersLock.Lock()
+  defer limitersLock.Unlock()
+
+  now := time.Now()
+  if (client.limiter == nil) {
+    client.limiter = &rateLimiter{}
+  }
+  allowed := client.limiter.allow(isMessage, props, now)
+  offender := client.limiter
+
+  if (client.Username != "") {
+    userLimiter, ok := userLimiters[client.Username]
+    if (!ok) {
+      pruneLimiters(now)
+      userLimiter = &rateLimiter{}
+      userLimiters[client.Username] = userLimiter
+    }
+    allowed = userLimiter.allow(isMessage, props, now) && allowed
+    offender = userLimiter
+  }
+
+  if (allowed) {
+    return RATE_OK
+  }
+  return offender.strike(props, now)
+}
+
+// remove the username limiters that haven't been used for a while (limitersLock must be held)
+func pruneLimiters(now time.Time) {
+  for username, limiter := range userLimiters {
+    if (now.Sub(limiter.lastUsed) > LIMITER_IDLE_TIMEOUT && now.Sub(limiter.lastStrike) > FLOOD_STRIKE_RESET) {
+      delete(userLimiters, username)
+    }
+  }
+}
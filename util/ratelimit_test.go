@@ -0,0 +1,33 @@
+package util
+
+import (
+  "testing"
+)
+
+func TestCheckRate(t *testing.T) {
+  props := Properties{MessagesPerMinute: 1, MessageBurst: 1, MaxMessageLength: 10, FloodWarnings: 1, FloodMuteSeconds: 60}
+  tests := []struct {
+    length int
+    expected int
+  }{
+    {5, RATE_OK},
+    // too long messages are rejected without counting as flooding
+    {11, RATE_TOO_LONG},
+    {11, RATE_TOO_LONG},
+    {11, RATE_TOO_LONG},
+    {5, RATE_WARN},
+    // within FLOOD_STRIKE_INTERVAL of the warning
+    {5, RATE_DROP},
+    {11, RATE_TOO_LONG},
+    {5, RATE_DROP},
+  }
+  client := &Client{}
+  for i, test := range tests {
+    if actual := client.CheckRate(true, test.length, props); actual != test.expected {
+      t.Errorf("message %d: expected %d but got %d", i, test.expected, actual)
+    }
+  }
+  if (client.limiter.strikes != 1) {
+    t.Errorf("expected 1 strike but there were %d", client.limiter.strikes)
+  }
+}
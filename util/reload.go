@@ -0,0 +1,100 @@
+package util
+
+import (
+  "fmt"
+  "os"
+  "reflect"
+  "time"
+)
+
+// read the config file again and apply the changed values
+// values tagged with reload:"restart" keep their current value (a warning is logged if they changed)
+// the current config is kept if the new config is invalid
+func ReloadConfig() error {
+  current := LoadConfig()
+  updated, err := ReadConfig(configFile)
+  if (err != nil) {
+    Errorf("Not reloading config: %v", err)
+    return err
+  }
+
+  currentValue := reflect.ValueOf(current)
+  updatedValue := reflect.ValueOf(&updated).Elem()
+  changed := []string{}
+  for i := 0; i < currentValue.NumField(); i++ {
+    field := currentValue.Type().Field(i)
+    if (reflect.DeepEqual(currentValue.Field(i).Interface(), updatedValue.Field(i).Interface())) {
+      continue
+    }
+
+    isSecret := field.Tag.Get("secret") == "true"
+    if (field.Tag.Get("reload") == "restart") {
+      if (isSecret) {
+        Warnf("Config %s changed but the server must be restarted to use it", field.Name)
+      } else {
+        Warnf("Config %s changed to %s but the server must be restarted to use it",
+            field.Name, describeValue(updatedValue.Field(i)))
+      }
+      updatedValue.Field(i).Set(currentValue.Field(i))
+    } else {
+      if (isSecret) {
+        // passwords, secrets and tokens must not end up in the server output
+        Infof("Config %s changed", field.Name)
+      } else {
+        Infof("Config %s changed from %s to %s", field.Name,
+            describeValue(currentValue.Field(i)), describeValue(updatedValue.Field(i)))
+      }
+      changed = append(changed, field.Name)
+    }
+  }
+  if (len(changed) == 0) {
+    return nil
+  }
+
+  configLock.Lock()
+  config = updated
+  configLock.Unlock()
+  SetLogLevel(updated.LogLevel)
+
+  if (updated.LogFile != current.LogFile || updated.LogFormat != current.LogFormat ||
+      updated.LogSyncInterval != current.LogSyncInterval) {
+    // the log will be reopened with the new settings on the next write
+    CloseLog()
+  }
+  return nil
+}
+
+// check the config file for changes every interval and reload it when it has been modified
+func WatchConfig(interval time.Duration) {
+  path := configFile
+  if (path == "") {
+    path = DEFAULT_CONFIG_FILE
+  }
+  lastModified := modifiedTime(path)
+
+  for range time.Tick(interval) {
+    modified := modifiedTime(path)
+    if (!modified.Equal(lastModified)) {
+      lastModified = modified
+      Infof("Config file %s has changed, reloading", path)
+      ReloadConfig()
+    }
+  }
+}
+
+// return when the file was last modified (or the zero time if it doesn't exist)
+func modifiedTime(path string) time.Time {
+  info, err := os.Stat(path)
+  if (err != nil) {
+    return time.Time{}
+  }
+  return info.ModTime()
+}
+
+// describe a config value for the server output
+func describeValue(value reflect.Value) string {
+  if (value.Kind() == reflect.String) {
+    return fmt.Sprintf("\"%s\"", value.String())
+  }
+  return fmt.Sprintf("%v", value.Interface())
+}
@@ -0,0 +1,38 @@
+package util
+
+import (
+  "bytes"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+func TestReloadDoesntLogSecrets(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "config.json")
+  os.WriteFile(path, []byte(`{"RolePasswords": {"joe": "first-digest"}, "IncomingWebhookTokens": ["first-token"]}`), 0600)
+  configFile = path
+  configLock.Lock()
+  isConfigLoaded = false
+  configLock.Unlock()
+  LoadConfig()
+
+  var output bytes.Buffer
+  logger.SetOutput(&output)
+  defer logger.SetOutput(os.Stdout)
+
+  os.WriteFile(path, []byte(`{"RolePasswords": {"joe": "second-digest"}, "IncomingWebhookTokens": ["second-token"],
+      "Webhooks": [{"URL": "http://localhost/hook", "Secret": "webhook-secret"}]}`), 0600)
+  if err := ReloadConfig(); err != nil {
+    t.Fatal(err)
+  }
+
+  for _, secret := range []string{"digest", "token", "webhook-secret"} {
+    if (strings.Contains(output.String(), secret)) {
+      t.Errorf("the reload output has the secret %q: %s", secret, output.String())
+    }
+  }
+  if (!strings.Contains(output.String(), "Config RolePasswords changed")) {
+    t.Errorf("expected the changed field to be reported: %s", output.String())
+  }
+}
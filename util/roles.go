@@ -0,0 +1,88 @@
+package util
+
+import (
+  "crypto/sha256"
+  "crypto/subtle"
+  "encoding/hex"
+  "sync"
+  "time"
+)
+
+// username -> when the user can talk again
+var mutes = map[string]time.Time{}
+var mutesLock sync.Mutex
+
+// return true if the value is in the list
+func containsString(values []string, value string) bool {
+  for _, v := range values {
+    if (v == value) {
+      return true
+    }
+  }
+  return false
+}
+
+// return true if the user has the role and has used "/auth" with the password from RolePasswords
+// (anyone can connect with any username so a role without a password is refused)
+func (client *Client) hasRole(usernames []string) bool {
+  if (client.Username == "" || !containsString(usernames, client.Username)) {
+    return false
+  }
+  if _, ok := LoadConfig().RolePasswords[client.Username]; !ok {
+    Warnf("Refusing the role for %s which has no RolePasswords entry", client.Username)
+    return false
+  }
+  return client.authenticated
+}
+
+// return true if the user is an admin
+func (client *Client) IsAdmin() bool {
+  return client.hasRole(LoadConfig().Admins)
+}
+
+// return true if the user is allowed to moderate other users (admins are also moderators)
+func (client *Client) IsModerator() bool {
+  return client.IsAdmin() || client.hasRole(LoadConfig().Moderators)
+}
+
+// return true if the user can kick, mute or ban the target user
+// moderators can't moderate other moderators or admins and admins can't moderate other admins
+func (client *Client) CanModerate(target string) bool {
+  props := LoadConfig()
+  if (!client.IsModerator() || target == client.Username || containsString(props.Admins, target)) {
+    return false
+  }
+  return client.IsAdmin() || !containsString(props.Moderators, target)
+}
+
+// check the password for the user's role (compared to the sha256 hex digest in RolePasswords)
+func (client *Client) Authenticate(password string) bool {
+  expected, ok := LoadConfig().RolePasswords[client.Username]
+  if (!ok || client.Username == "") {
+    return false
+  }
+  digest := sha256.Sum256([]byte(password))
+  actual := hex.EncodeToString(digest[:])
+  client.authenticated = subtle.ConstantTimeCompare([]byte(actual), []byte(expected)) == 1
+  return client.authenticated
+}
+
+// don't allow the user to send anything to other users until the time has passed
+func Mute(username string, until time.Time) {
+  mutesLock.Lock()
+  defer mutesLock.Unlock()
+  mutes[username] = until
+}
+
+// return true if the user has been muted (and when they can talk again)
+func (client *Client) IsMuted() (bool, time.Time) {
+  mutesLock.Lock()
+  defer mutesLock.Unlock()
+
+  until, ok := mutes[client.Username]
+  if (ok && time.Now().After(until)) {
+    delete(mutes, client.Username)
+    return false, until
+  }
+  return ok, until
+}
@@ -0,0 +1,78 @@
+package util
+
+import (
+  "net"
+  "os"
+  "path/filepath"
+  "testing"
+)
+
+// load the config from the JSON (for tests)
+func loadTestConfig(t *testing.T, value string) {
+  path := filepath.Join(t.TempDir(), "config.json")
+  os.WriteFile(path, []byte(value), 0600)
+  configFile = path
+  configLock.Lock()
+  isConfigLoaded = false
+  configLock.Unlock()
+  LoadConfig()
+}
+
+func TestRolesNeedAuthentication(t *testing.T) {
+  // the digest of "secret"
+  loadTestConfig(t, `{"Admins": ["ann"], "Moderators": ["mo"],
+      "RolePasswords": {"ann": "2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b"}}`)
+  server, other := net.Pipe()
+  defer server.Close()
+  defer other.Close()
+
+  ann := &Client{Connection: server, Username: "ann"}
+  if (ann.IsAdmin()) {
+    t.Errorf("expected the admin role to need authentication")
+  }
+  if (ann.Authenticate("wrong") || ann.IsAdmin()) {
+    t.Errorf("expected the wrong password to be refused")
+  }
+  if (!ann.Authenticate("secret") || !ann.IsAdmin() || !ann.IsModerator()) {
+    t.Errorf("expected the admin role after authenticating")
+  }
+
+  mo := &Client{Connection: server, Username: "mo", authenticated: true}
+  if (mo.IsModerator()) {
+    t.Errorf("expected the moderator role without a password to be refused")
+  }
+}
+
+func TestRedactIP(t *testing.T) {
+  values := map[string]string{
+    "10.0.0.5": "10.0.0.x",
+    "2001:db8:1:2::5": "2001:db8:1::x",
+    "joe": "joe",
+  }
+  for value, expected := range values {
+    if actual := RedactIP(value); actual != expected {
+      t.Errorf("RedactIP(%q) = %q, expected %q", value, actual, expected)
+    }
+  }
+}
+
+func TestBannedAddressIsOnlyRedactedForUsers(t *testing.T) {
+  tests := []struct {
+    action Action
+    expected string
+  }{
+    {Action{Command: "ban", Content: Encode("2001:db8:1:2::5")}, Encode("2001:db8:1::x")},
+    {Action{Command: "unban", Content: "10.0.0.5"}, "10.0.0.x"},
+    {Action{Command: "ban", Content: "joe"}, "joe"},
+    {Action{Command: "message", Content: "10.0.0.5"}, "10.0.0.5"},
+  }
+  for _, test := range tests {
+    content := test.action.Content
+    if actual := shownAction(test.action).Content; actual != test.expected {
+      t.Errorf("expected /%v %q to be shown as %q but got %q", test.action.Command, content, test.expected, actual)
+    }
+    if (test.action.Content != content) {
+      t.Errorf("expected the logged /%v to keep %q", test.action.Command, content)
+    }
+  }
+}
@@ -0,0 +1,140 @@
+package util
+
+import (
+  "compress/gzip"
+  "io"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+  "time"
+)
+
+// suffix added to rotated log files (before the optional ".gz")
+const ROTATED_LOG_LAYOUT = "20060102-150405.000"
+
+// when (and how) the audit log should be rotated
+type LogRotation struct {
+  // rotate when the file reaches this many bytes (0 for no limit)
+  MaxSize int64
+  // rotate at the start of each interval (0 for no limit) - intervals are multiples of the interval since the zero time
+  // (like time.Truncate) so an interval that divides a day starts at midnight UTC, and a file last written in an
+  // earlier interval is rotated even if the server has been restarted
+  Interval time.Duration
+  // number of rotated files to keep (0 to keep them all)
+  MaxBackups int
+  // gzip rotated files
+  Compress bool
+}
+
+// return the rotation settings for the config properties
+func logRotation(props Properties) LogRotation {
+  return LogRotation{
+    MaxSize: int64(props.LogMaxSize) * 1024 * 1024,
+    Interval: time.Duration(props.LogRotateInterval) * time.Hour,
+    MaxBackups: props.LogMaxBackups,
+    Compress: props.LogCompress,
+  }
+}
+
+// rotate the log file if it is too big or too old (the sink lock must be held)
+func (sink *LogSink) rotateIfNeeded() error {
+  size := sink.size + int64(sink.buffer.Buffered())
+  isTooBig := sink.Rotation.MaxSize > 0 && size >= sink.Rotation.MaxSize
+  isTooOld := sink.Rotation.Interval > 0 &&
+      time.Now().Truncate(sink.Rotation.Interval).After(sink.started.Truncate(sink.Rotation.Interval))
+  if (!isTooBig && !isTooOld) {
+    return nil
+  }
+  return sink.rotate()
+}
+
+// move the current log file out of the way and start a new one (the sink lock must be held)
+func (sink *LogSink) rotate() error {
+  err := sink.sync()
+  if (err != nil) {
+    return err
+  }
+  sink.file.Close()
+
+  rotatedPath := sink.Path + "." + time.Now().Format(ROTATED_LOG_LAYOUT)
+  err = os.Rename(sink.Path, rotatedPath)
+  if (err != nil) {
+    // keep logging to the original file (we'll try again next time)
+    if openErr := sink.open(); openErr != nil {
+      Errorf("Can't reopen log file %s: %v", sink.Path, openErr)
+    }
+    return err
+  }
+  Infof("Rotated log file %s to %s", sink.Path, rotatedPath)
+
+  err = sink.open()
+  if (err != nil) {
+    return err
+  }
+
+  // compressing and cleaning up can happen while we keep logging
+  rotation := sink.Rotation
+  go func() {
+    if (rotation.Compress) {
+      if err := compressFile(rotatedPath); err != nil {
+        Errorf("Can't compress log file %s: %v", rotatedPath, err)
+      }
+    }
+    removeOldLogs(sink.Path, rotation.MaxBackups)
+  }()
+  return nil
+}
+
+// gzip the file (to "{path}.gz") and remove the original
+func compressFile(path string) error {
+  in, err := os.Open(path)
+  if (err != nil) {
+    return err
+  }
+  defer in.Close()
+
+  out, err := os.OpenFile(path + ".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+  if (err != nil) {
+    return err
+  }
+  writer := gzip.NewWriter(out)
+  _, err = io.Copy(writer, in)
+  if (err == nil) {
+    err = writer.Close()
+  }
+  if closeErr := out.Close(); err == nil {
+    err = closeErr
+  }
+  if (err != nil) {
+    os.Remove(path + ".gz")
+    return err
+  }
+  return os.Remove(path)
+}
+
+// remove the oldest rotated log files so only maxBackups remain
+func removeOldLogs(path string, maxBackups int) {
+  if (maxBackups <= 0) {
+    return
+  }
+
+  matches, _ := filepath.Glob(path + ".*")
+  backups := []string{}
+  for _, match := range matches {
+    // only look at files we have rotated
+    suffix := strings.TrimSuffix(match[len(path) + 1:], ".gz")
+    if _, err := time.Parse(ROTATED_LOG_LAYOUT, suffix); err == nil {
+      backups = append(backups, match)
+    }
+  }
+
+  // the timestamp suffix sorts oldest first
+  sort.Strings(backups)
+  for len(backups) > maxBackups {
+    if err := os.Remove(backups[0]); err != nil {
+      Errorf("Can't remove old log file %s: %v", backups[0], err)
+    }
+    backups = backups[1:]
+  }
+}
@@ -0,0 +1,71 @@
+package util
+
+import (
+  "os"
+  "path/filepath"
+  "testing"
+  "time"
+)
+
+func TestRotateOldFileAfterRestart(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "chat.log")
+  err := os.WriteFile(path, []byte("username,action\n"), 0600)
+  if (err != nil) {
+    t.Fatal(err)
+  }
+  // the file was last written before the current interval started
+  old := time.Now().Add(-2 * time.Hour)
+  os.Chtimes(path, old, old)
+
+  sink, err := OpenLogSink(path, LOG_FORMAT_CSV, LogRotation{Interval: time.Hour}, 0)
+  if (err != nil) {
+    t.Fatal(err)
+  }
+  defer sink.Close()
+  if err := sink.Write(Action{Command: "message", Content: "hello"}); err != nil {
+    t.Fatal(err)
+  }
+
+  rotated, _ := filepath.Glob(path + ".*")
+  if (len(rotated) != 1) {
+    t.Errorf("expected the old file to be rotated but found %v", rotated)
+  }
+}
+
+func TestDontRotateCurrentFile(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "chat.log")
+  sink, err := OpenLogSink(path, LOG_FORMAT_CSV, LogRotation{Interval: 24 * time.Hour}, 0)
+  if (err != nil) {
+    t.Fatal(err)
+  }
+  defer sink.Close()
+  sink.Write(Action{Command: "message", Content: "hello"})
+  sink.Reopen()
+  sink.Write(Action{Command: "message", Content: "again"})
+
+  rotated, _ := filepath.Glob(path + ".*")
+  if (len(rotated) != 0) {
+    t.Errorf("expected the file not to be rotated but found %v", rotated)
+  }
+}
+
+func TestReopenFailureKeepsTheOldFile(t *testing.T) {
+  dir := filepath.Join(t.TempDir(), "logs")
+  os.Mkdir(dir, 0700)
+  sink, err := OpenLogSink(filepath.Join(dir, "chat.log"), LOG_FORMAT_CSV, LogRotation{}, 0)
+  if (err != nil) {
+    t.Fatal(err)
+  }
+  defer sink.Close()
+  // the log can't be created again once its directory is gone
+  os.RemoveAll(dir)
+  if err := sink.Reopen(); err == nil {
+    t.Errorf("expected an error reopening the log")
+  }
+  if err := sink.Write(Action{Command: "message", Content: "hello"}); err != nil {
+    t.Errorf("expected to keep writing to the old file but got %v", err)
+  }
+  if err := sink.Sync(); err != nil {
+    t.Errorf("expected to keep syncing the old file but got %v", err)
+  }
+}
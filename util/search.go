@@ -0,0 +1,353 @@
+package util
+
+import (
+  "html"
+  "math"
+  "sort"
+  "strings"
+  "sync"
+  "unicode"
+)
+
+// markers placed around matched terms in search result snippets
+const HIGHLIGHT_START = "<em>"
+const HIGHLIGHT_END = "</em>"
+// number of characters of context shown on either side of the first match in a snippet
+const SNIPPET_CONTEXT = 40
+
+// a single search hit (the matched action plus ranking details)
+type SearchResult struct {
+  Action
+  // relevance score (higher is better)
+  Score float64       `json:"score"`
+  // decoded message content with the matched terms highlighted
+  Snippet string      `json:"snippet"`
+}
+
+// a word found in some content along with where it was found
+type token struct {
+  // lower cased word
+  Text string
+  // byte offsets of the word in the original content
+  Start, End int
+}
+
+// one part of a search query - either a single word or a quoted phrase
+type queryTerm struct {
+  Words []string
+}
+
+// inverted index of action content (maintained as actions are logged)
+type searchIndex struct {
+  lock sync.RWMutex
+  // word -> action index -> word positions within that action
+  postings map[string]map[int][]int
+  // action index -> number of words in that action
+  lengths map[int]int
+}
+
+var index = searchIndex{
+  postings: map[string]map[int][]int{},
+  lengths: map[int]int{},
+}
+
+// split content into lower cased words (letters and digits) keeping their offsets
+func tokenize(content string) []token {
+  rtn := []token{}
+  start := -1
+  for i, r := range content {
+    isWordChar := unicode.IsLetter(r) || unicode.IsDigit(r)
+    if (isWordChar && start < 0) {
+      start = i
+    } else if (!isWordChar && start >= 0) {
+      rtn = append(rtn, token{Text: strings.ToLower(content[start:i]), Start: start, End: i})
+      start = -1
+    }
+  }
+  if (start >= 0) {
+    rtn = append(rtn, token{Text: strings.ToLower(content[start:]), Start: start, End: len(content)})
+  }
+  return rtn
+}
+
+// remove the (decoded) content of an action from the index
+func (idx *searchIndex) remove(doc int, content string) {
+  idx.lock.Lock()
+  defer idx.lock.Unlock()
+
+  for _, tok := range tokenize(content) {
+    if docs, ok := idx.postings[tok.Text]; ok {
+      delete(docs, doc)
+      if (len(docs) == 0) {
+        delete(idx.postings, tok.Text)
+      }
+    }
+  }
+  delete(idx.lengths, doc)
+}
+
+// add the (decoded) content of an action to the index
+func (idx *searchIndex) add(doc int, content string) {
+  idx.lock.Lock()
+  defer idx.lock.Unlock()
+
+  tokens := tokenize(content)
+  for position, tok := range tokens {
+    docs, ok := idx.postings[tok.Text]
+    if (!ok) {
+      docs = map[int][]int{}
+      idx.postings[tok.Text] = docs
+    }
+    docs[doc] = append(docs[doc], position)
+  }
+  idx.lengths[doc] = len(tokens)
+}
+
+// find the positions (within a doc) where the term starts
+func (idx *searchIndex) termPositions(term queryTerm, doc int) []int {
+  first := idx.postings[term.Words[0]][doc]
+  if (len(term.Words) == 1) {
+    return first
+  }
+
+  rtn := []int{}
+  for _, start := range first {
+    isMatch := true
+    for offset, word := range term.Words[1:] {
+      if (!containsInt(idx.postings[word][doc], start + offset + 1)) {
+        isMatch = false
+        break
+      }
+    }
+    if (isMatch) {
+      rtn = append(rtn, start)
+    }
+  }
+  return rtn
+}
+
+// return the docs matching the term and the number of times it occurs in each
+func (idx *searchIndex) termMatches(term queryTerm) map[int]int {
+  rtn := map[int]int{}
+  for doc := range idx.postings[term.Words[0]] {
+    if count := len(idx.termPositions(term, doc)); count > 0 {
+      rtn[doc] = count
+    }
+  }
+  return rtn
+}
+
+// score all docs matching the query - groups are OR'd together and terms within a group are AND'd
+func (idx *searchIndex) search(groups [][]queryTerm) map[int]float64 {
+  idx.lock.RLock()
+  defer idx.lock.RUnlock()
+
+  total := float64(len(idx.lengths))
+  rtn := map[int]float64{}
+
+  for _, group := range groups {
+    var groupScores map[int]float64
+    for _, term := range group {
+      matches := idx.termMatches(term)
+      // rarer terms (and phrases) are worth more
+      idf := math.Log(1 + total / float64(len(matches) + 1)) * float64(len(term.Words))
+
+      termScores := map[int]float64{}
+      for doc, count := range matches {
+        if (groupScores != nil) {
+          if _, ok := groupScores[doc]; !ok {
+            continue
+          }
+        }
+        termScores[doc] = float64(count) * idf / math.Sqrt(float64(idx.lengths[doc]))
+        if (groupScores != nil) {
+          termScores[doc] += groupScores[doc]
+        }
+      }
+      groupScores = termScores
+    }
+
+    for doc, score := range groupScores {
+      if (score > rtn[doc]) {
+        rtn[doc] = score
+      }
+    }
+  }
+  return rtn
+}
+
+// parse a search query into OR'd groups of AND'd terms
+// words are case-insensitive, "quoted text" is a phrase and OR (upper case) separates alternatives
+func parseQuery(query string) [][]queryTerm {
+  rtn := [][]queryTerm{}
+  group := []queryTerm{}
+
+  parts := strings.Split(query, "\"")
+  for i, part := range parts {
+    if (i % 2 == 1) {
+      // inside of quotes - this is a phrase
+      if words := tokenWords(part); len(words) > 0 {
+        group = append(group, queryTerm{Words: words})
+      }
+      continue
+    }
+
+    for _, field := range strings.Fields(part) {
+      if (field == "OR") {
+        if (len(group) > 0) {
+          rtn = append(rtn, group)
+        }
+        group = []queryTerm{}
+      } else if (field != "AND") {
+        for _, word := range tokenWords(field) {
+          group = append(group, queryTerm{Words: []string{word}})
+        }
+      }
+    }
+  }
+
+  if (len(group) > 0) {
+    rtn = append(rtn, group)
+  }
+  return rtn
+}
+
+// return just the (lower cased) words of the content
+func tokenWords(content string) []string {
+  tokens := tokenize(content)
+  rtn := make([]string, len(tokens))
+  for i, tok := range tokens {
+    rtn[i] = tok.Text
+  }
+  return rtn
+}
+
+// return the content around the first match with all matched words highlighted
+// the content is HTML escaped (only the highlight tags are markup)
+func highlight(content string, groups [][]queryTerm) string {
+  words := map[string]bool{}
+  for _, group := range groups {
+    for _, term := range group {
+      for _, word := range term.Words {
+        words[word] = true
+      }
+    }
+  }
+
+  tokens := tokenize(content)
+  first := -1
+  for i, tok := range tokens {
+    if (words[tok.Text]) {
+      first = i
+      break
+    }
+  }
+  if (first < 0) {
+    return html.EscapeString(content)
+  }
+
+  // only show some context around the first match
+  start := tokens[first].Start - SNIPPET_CONTEXT
+  prefix := "..."
+  if (start <= 0) {
+    start = 0
+    prefix = ""
+  } else {
+    for start < len(content) && content[start] & 0xC0 == 0x80 {
+      // don't split a multi-byte character
+      start++
+    }
+  }
+  end := tokens[first].End + SNIPPET_CONTEXT
+  suffix := "..."
+  if (end >= len(content)) {
+    end = len(content)
+    suffix = ""
+  } else {
+    for end < len(content) && content[end] & 0xC0 == 0x80 {
+      end++
+    }
+  }
+
+  var rtn strings.Builder
+  rtn.WriteString(prefix)
+  last := start
+  for _, tok := range tokens {
+    if (tok.Start < start || tok.End > end || !words[tok.Text]) {
+      continue
+    }
+    rtn.WriteString(html.EscapeString(content[last:tok.Start]))
+    rtn.WriteString(HIGHLIGHT_START + html.EscapeString(content[tok.Start:tok.End]) + HIGHLIGHT_END)
+    last = tok.End
+  }
+  rtn.WriteString(html.EscapeString(content[last:end]))
+  rtn.WriteString(suffix)
+  return rtn.String()
+}
+
+// add a logged action to the search index
+func indexAction(doc int, action Action) {
+  index.add(doc, Decode(action.Content))
+}
+
+// full-text search across the actions using the search index
+// results are ranked by relevance (most recent first for equal scores) and limited to "limit" (if > 0)
+// empty actionType, username or room values match everything
+func SearchMessages(actionType string, query string, username string, room string, limit int) ([]SearchResult) {
+  groups := parseQuery(query)
+  rtn := []SearchResult{}
+  if (len(groups) == 0) {
+    return rtn
+  }
+
+  scores := index.search(groups)
+  docs := make([]int, 0, len(scores))
+  for doc := range scores {
+    docs = append(docs, doc)
+  }
+  sort.Slice(docs, func(i, j int) bool {
+    if (scores[docs[i]] == scores[docs[j]]) {
+      return docs[i] > docs[j]
+    }
+    return scores[docs[i]] > scores[docs[j]]
+  })
+
+  actionsLock.RLock()
+  defer actionsLock.RUnlock()
+  for _, doc := range docs {
+    action := actions[doc]
+    if (actionType != "" && action.Command != actionType) {
+      continue
+    }
+    if (username != "" && action.Username != username) {
+      continue
+    }
+    if (room != "" && action.Room != room) {
+      continue
+    }
+    action, ok := currentMessage(action)
+    if (!ok) {
+      continue
+    }
+    rtn = append(rtn, SearchResult{
+      Action: action,
+      Score: scores[doc],
+      Snippet: highlight(Decode(action.Content), groups),
+    })
+  }
+
+  if (limit > 0 && len(rtn) > limit) {
+    rtn = rtn[:limit]
+  }
+  return rtn
+}
+
+// return true if the value is in the list
+func containsInt(values []int, value int) bool {
+  for _, v := range values {
+    if (v == value) {
+      return true
+    }
+  }
+  return false
+}
@@ -0,0 +1,52 @@
+package util
+
+import (
+  "fmt"
+  "sync"
+  "testing"
+)
+
+func TestHighlightEscapesContent(t *testing.T) {
+  snippet := highlight(`<script>alert("hi")</script> hello`, parseQuery("hello"))
+  expected := `&lt;script&gt;alert(&#34;hi&#34;)&lt;/script&gt; <em>hello</em>`
+  if (snippet != expected) {
+    t.Errorf("expected %q but got %q", expected, snippet)
+  }
+}
+
+func TestHighlightEscapesContentWithoutMatch(t *testing.T) {
+  snippet := highlight(`<b>bold</b>`, parseQuery("missing"))
+  if (snippet != "&lt;b&gt;bold&lt;/b&gt;") {
+    t.Errorf("unexpected snippet %q", snippet)
+  }
+}
+
+// run with -race: the index must only have the content of the last edit however the edits interleave
+func TestConcurrentEditsLeaveTheCurrentContentIndexed(t *testing.T) {
+  message := addAction(Action{Command: "message", Content: "original"})
+  var wait sync.WaitGroup
+  for i := 0; i < 20; i++ {
+    wait.Add(1)
+    go func(i int) {
+      defer wait.Done()
+      addAction(Action{Command: "edit", Target: message.ID, Content: fmt.Sprintf("revision%d", i)})
+    }(i)
+  }
+  wait.Wait()
+
+  actionsLock.RLock()
+  doc := messageDocs[message.ID]
+  current := messageView(actions[doc]).Content
+  actionsLock.RUnlock()
+  index.lock.RLock()
+  defer index.lock.RUnlock()
+  for i := 0; i < 20; i++ {
+    word := fmt.Sprintf("revision%d", i)
+    if _, ok := index.postings[word][doc]; ok != (word == current) {
+      t.Errorf("expected only %q to be indexed for the message but %q is %v", current, word, ok)
+    }
+  }
+  if _, ok := index.postings["original"][doc]; ok {
+    t.Errorf("expected the original content to be removed from the index")
+  }
+}
@@ -0,0 +1,120 @@
+package util
+
+import (
+  "crypto/rand"
+  "encoding/hex"
+  "sync"
+  "time"
+)
+
+// a user's session which can be resumed by a new connection (after a network problem or server restart)
+type session struct {
+  // the connection currently using the session
+  client *Client
+  // broadcasts the disconnect when the session isn't resumed in time (nil while connected)
+  expiry *time.Timer
+}
+
+// session token -> session
+var sessions = map[string]*session{}
+var sessionsLock sync.Mutex
+
+// start a session for the client (after the "user" handshake) and return its token
+func (client *Client) StartSession() string {
+  bytes := make([]byte, 16)
+  _, err := rand.Read(bytes)
+  CheckForError(err, "Can't create session token")
+  token := hex.EncodeToString(bytes)
+
+  sessionsLock.Lock()
+  defer sessionsLock.Unlock()
+  sessions[token] = &session{client: client}
+  client.session = token
+  return token
+}
+
+// end the client's session so it can't be resumed
+func (client *Client) EndSession() {
+  sessionsLock.Lock()
+  defer sessionsLock.Unlock()
+
+  if current, ok := sessions[client.session]; ok && current.client == client {
+    if (current.expiry != nil) {
+      current.expiry.Stop()
+    }
+    delete(sessions, client.session)
+  }
+}
+
+// handle a connection that was lost (rather than closed on purpose)
+// if the client has a session, the disconnect isn't broadcast until the grace period is over so the session can be
+// resumed by a new connection without anyone noticing
+func (client *Client) Lost(grace time.Duration) {
+  sessionsLock.Lock()
+  current, ok := sessions[client.session]
+  if (ok && current.client != client) {
+    // the session has already been resumed by another connection
+    sessionsLock.Unlock()
+    client.disconnect(false)
+    return
+  }
+  if (!ok || grace <= 0) {
+    sessionsLock.Unlock()
+    client.Close(true)
+    return
+  }
+
+  token := client.session
+  current.expiry = time.AfterFunc(grace, func() {
+    sessionsLock.Lock()
+    expired := sessions[token] == current && current.client == client
+    if (expired) {
+      delete(sessions, token)
+    }
+    sessionsLock.Unlock()
+
+    if (expired) {
+      Infof("Session for %s has expired", client.Username)
+      SendClientMessage("disconnect", "", client, false, LoadConfig())
+    }
+  })
+  sessionsLock.Unlock()
+  client.disconnect(false)
+}
+
+// take over the session with the token (the username, room, ignores and role of the previous connection)
+// false is returned if the session doesn't exist or has expired
+func (client *Client) Resume(token string) bool {
+  sessionsLock.Lock()
+  current, ok := sessions[token]
+  if (!ok) {
+    sessionsLock.Unlock()
+    return false
+  }
+  if (current.expiry != nil) {
+    current.expiry.Stop()
+    current.expiry = nil
+  }
+
+  previous := current.client
+  previous.lock.Lock()
+  ignoring := append([]string{}, previous.ignoring...)
+  previous.lock.Unlock()
+  username, room := previous.Identity()
+  client.lock.Lock()
+  client.Username = username
+  client.Room = room
+  client.ignoring = ignoring
+  client.lock.Unlock()
+  client.authenticated = previous.authenticated
+  client.limiter = previous.limiter
+  client.session = token
+  current.client = client
+  sessionsLock.Unlock()
+
+  if (previous.IsConnected()) {
+    // the previous connection hasn't noticed that it is gone yet
+    previous.disconnect(false)
+  }
+  return true
+}
@@ -0,0 +1,103 @@
+package util
+
+import (
+  "sync"
+)
+
+// number of actions a subscription can fall behind by before it is closed
+const SUBSCRIPTION_BUFFER = 256
+// actions that are never streamed (they are only for the users involved)
+var PRIVATE_ACTIONS = map[string]bool{"direct": true, "ignoring": true}
+
+// which actions to stream (a filter that is empty matches everything)
+type ActionFilter struct {
+  Rooms []string
+  Users []string
+  Commands []string
+}
+
+// new actions matching a filter as they are logged
+// Actions is closed if the subscriber falls too far behind (it can resume from the last action it got)
+type Subscription struct {
+  Actions chan Action
+  filter ActionFilter
+}
+
+// current subscriptions
+var subscriptions = map[*Subscription]bool{}
+var subscriptionsLock sync.Mutex
+
+// return true if the action should be streamed for the filter
+func (filter ActionFilter) Matches(action Action) bool {
+  if (PRIVATE_ACTIONS[action.Command]) {
+    return false
+  }
+  if (len(filter.Rooms) > 0 && !containsString(filter.Rooms, action.Room)) {
+    return false
+  }
+  if (len(filter.Users) > 0 && !containsString(filter.Users, action.Username)) {
+    return false
+  }
+  if (len(filter.Commands) > 0 && !containsString(filter.Commands, action.Command)) {
+    return false
+  }
+  return true
+}
+
+// start receiving new actions that match the filter (Close must be called when done)
+func Subscribe(filter ActionFilter) *Subscription {
+  subscription := &Subscription{Actions: make(chan Action, SUBSCRIPTION_BUFFER), filter: filter}
+  subscriptionsLock.Lock()
+  defer subscriptionsLock.Unlock()
+  subscriptions[subscription] = true
+  return subscription
+}
+
+// stop receiving actions
+func (subscription *Subscription) Close() {
+  subscriptionsLock.Lock()
+  defer subscriptionsLock.Unlock()
+  if (subscriptions[subscription]) {
+    delete(subscriptions, subscription)
+    close(subscription.Actions)
+  }
+}
+
+// send a new action to the subscriptions it matches
+// subscriptions that have fallen behind are closed rather than holding up the server
+func publishAction(action Action) {
+  subscriptionsLock.Lock()
+  defer subscriptionsLock.Unlock()
+  for subscription := range subscriptions {
+    if (!subscription.filter.Matches(action)) {
+      continue
+    }
+    select {
+      case subscription.Actions <- action:
+      default:
+        Warnf("Closing stream subscription which has fallen behind")
+        delete(subscriptions, subscription)
+        close(subscription.Actions)
+    }
+  }
+}
+
+// return the actions after the id that match the filter (oldest first)
+func ActionsSince(id int64, filter ActionFilter) []Action {
+  actionsLock.RLock()
+  defer actionsLock.RUnlock()
+  rtn := []Action{}
+  for _, action := range actions {
+    if (action.ID > id && filter.Matches(action)) {
+      rtn = append(rtn, action)
+    }
+  }
+  return rtn
+}
+
+// return the id of the newest action (0 if there aren't any)
+func LastActionID() int64 {
+  actionsLock.RLock()
+  defer actionsLock.RUnlock()
+  return nextActionID - 1
+}
@@ -3,21 +3,28 @@ package util
 import (
   "os"
   "strings"
-  "encoding/json"
-  "io/ioutil"
   "net"
   "time"
   "fmt"
+  "sync"
 )
 
 // time format for log files and JSON response
 const TIME_LAYOUT = "Jan 2 2006 15.04.05 -0700 MST"
+// clients that send "/protocol 2" (or higher) receive the message id and timestamp with each action
+// "/{action} [{username}] {{id} {unix seconds}} {content}"
+const PROTOCOL_VERSION = 2
 // thins we are encoding when sending stuff over the wire to clients
 var ENCODING_UNENCODED_TOKENS = []string{"%", ":", "[", "]", ",", "\""}
 var ENCODING_ENCODED_TOKENS = []string{"%25", "%3A", "%5B", "%5D", "%2C", "%22"}
 var DECODING_UNENCODED_TOKENS = []string{":", "[", "]", ",", "\"", "%"}
 var DECODING_ENCODED_TOKENS = []string{"%3A", "%5B", "%5D", "%2C", "%22", "%25"}
 
+// the room clients are in when they aren't in a private room
+const LOBBY = "lobby"
+// actions that are only sent to clients in the same room as the action
+var ROOM_ACTIONS = map[string]bool{"message": true, "edit": true, "delete": true, "react": true}
+
 // Container for client username and connection details
 type Client struct {
   // the client's connection
@@ -28,30 +35,129 @@ type Client struct {
   Room string
   // list of usernames we are ignoring
   ignoring []string
-  // the config properties
-  Properties Properties
+  // the chat protocol version the client understands (see PROTOCOL_VERSION)
+  Protocol int
+  // true once the user has provided their password with "/auth"
+  authenticated bool
+  // rate limits for this connection (see CheckRate)
+  limiter *rateLimiter
+  // token of the client's session (empty if it doesn't have one)
+  session string
+  // where the client's actions come from (empty for chat connections, "webhook" for incoming webhooks)
+  source string
+  // true once the connection has been closed and once the other users have been told (see disconnect)
+  closed bool
+  announced bool
+  // the username and protocol once the handshake is done (see FinishHandshake)
+  handshake bool
+  handshakeUsername string
+  handshakeProtocol int
+  // guards closed, announced, the handshake values and changes to Username, Room and ignoring
+  // (which are used by the connection's other goroutines and by other connections)
+  lock sync.Mutex
 }
 // Close the client connection and clenup
+// the client's session is ended so it can't be resumed
 func (client *Client) Close(doSendMessage bool) {
-  if (doSendMessage) {
+  client.EndSession()
+  client.disconnect(doSendMessage)
+}
+
+// close the client connection (keeping the session) and remove the client
+// this can be called more than once but the connection is only closed (and the disconnect only sent) once
+func (client *Client) disconnect(doSendMessage bool) {
+  client.lock.Lock()
+  announce := doSendMessage && !client.announced
+  client.announced = client.announced || doSendMessage
+  alreadyClosed := client.closed
+  client.closed = true
+  client.lock.Unlock()
+
+  if (announce) {
     // if we send the close command, the connection will terminate causing another close
     // which will send the message
-    SendClientMessage("disconnect", "", client, false, client.Properties)
+    SendClientMessage("disconnect", "", client, false, LoadConfig())
+  }
+  if (alreadyClosed) {
+    return
   }
   client.Connection.Close();
+  clientsLock.Lock()
   clients = removeEntry(client, clients);
+  clientsLock.Unlock()
+}
+
+// record that the client has finished the handshake ("/user" or "/resume") with its current username and protocol
+// only the goroutine handling the client's commands changes Username and Protocol - the connection's other goroutines
+// must use Handshake instead
+func (client *Client) FinishHandshake() {
+  client.lock.Lock()
+  defer client.lock.Unlock()
+  client.handshake = true
+  client.handshakeUsername = client.Username
+  client.handshakeProtocol = client.Protocol
+}
+
+// return the username and protocol the client finished the handshake with (false if it hasn't yet)
+func (client *Client) Handshake() (string, int, bool) {
+  client.lock.Lock()
+  defer client.lock.Unlock()
+  return client.handshakeUsername, client.handshakeProtocol, client.handshake
 }
 
 // Register the connection and cache it
 func (client *Client) Register() {
+  clientsLock.Lock()
   clients = append(clients, client);
+  clientsLock.Unlock()
+}
+
+// return true until the client has been closed
+func (client *Client) IsConnected() bool {
+  for _, value := range ConnectedClients() {
+    if (value == client) {
+      return true
+    }
+  }
+  return false
+}
+
+// return the client's IP address (without the port)
+func (client *Client) IP() string {
+  return RemoteIP(client.Connection)
+}
+
+// change the client's username (other connections must read it with Identity)
+func (client *Client) SetUsername(username string) {
+  client.lock.Lock()
+  defer client.lock.Unlock()
+  client.Username = username
+}
+
+// change the client's room (other connections must read it with Identity)
+func (client *Client) SetRoom(room string) {
+  client.lock.Lock()
+  defer client.lock.Unlock()
+  client.Room = room
+}
+
+// return the client's username and room
+// only the goroutine handling the client's commands changes them so it can read Username and Room directly
+func (client *Client) Identity() (string, string) {
+  client.lock.Lock()
+  defer client.lock.Unlock()
+  return client.Username, client.Room
 }
 
 func (client *Client) Ignore(username string) {
+  client.lock.Lock()
+  defer client.lock.Unlock()
   client.ignoring = append(client.ignoring, username)
 }
 
 func (client *Client) IsIgnoring(username string) bool {
+  client.lock.Lock()
+  defer client.lock.Unlock()
   for _, value := range client.ignoring {
     if (value == username) {
       return true;
@@ -62,80 +168,38 @@ func (client *Client) IsIgnoring(username string) bool {
 
 // log content container
 type Action struct {
-  // "message", "leave", "enter", "connect", "disconnect"
+  // unique (increasing) id of the action
+  ID int64            `json:"id"`
+  // "message", "leave", "enter", "connect", "disconnect", "edit", "delete", "react"
   Command string      `json:"command"`
-  // action specific content - either the chat message or room that was entered/left
+  // action specific content - either the chat message, room that was entered/left or the edited message
   Content string      `json:"content"`
+  // the id of the message the action applies to ("edit", "delete", "react" or the parent of a reply "message")
+  Target int64        `json:"target,omitempty"`
+  // the user a "direct" message was sent to
+  Recipient string    `json:"recipient,omitempty"`
   // the username that performed the action
   Username string     `json:"username"`
+  // the room the user was in when the action was performed
+  Room string         `json:"room"`
   // ip address of the uwer
   IP string           `json:"ip"`
+  // where the action came from if it wasn't a chat connection ("webhook")
+  Source string       `json:"source,omitempty"`
   // timestamp of the activity
   Timestamp string    `json:"timestamp"`
 }
 
-// general configuration properties
-type Properties struct {
-  // chat server hostname (for client connection)
-  Hostname string
-  // chat server port (for server execution and client connection)
-  Port string
-  // port used for JSON server
-  JSONEndpointPort string
-  // message format for when someone enters a private room
-  HasEnteredTheRoomMessage string
-  // message format for when someone leaves a private room
-  HasLeftTheRoomMessage string
-  // message format for when someone connects
-  HasEnteredTheLobbyMessage string
-  // message format for when someone disconnects
-  HasLeftTheLobbyMessage string
-  // message format for when someone sends a chat
-  ReceivedAMessage string
-  // message received when the user is ignoring someone else
-  IgnoringMessage string
-  // the absolute log file location
-  LogFile string
-}
-
 // all actions (chats, enter/leave private room, connect/disconnect)
 // that have occured while the server has been running
 var actions = []Action{}
-// cached config properties
-var config = Properties{}
-// static client list
+// guards the actions list (which is written by client connections and read by the JSON endpoint)
+var actionsLock sync.RWMutex
+// id to be used for the next action
+var nextActionID int64 = 1
+// static client list (replaced rather than modified so it can be iterated without holding the lock)
 var clients []*Client
-
-// load the configuration properties from the "config.json" file
-func LoadConfig() Properties {
-  if (config.Port != "") {
-    return config;
-  }
-  pwd, _ := os.Getwd()
-
-  payload, err := ioutil.ReadFile(pwd + "/config.json")
-  CheckForError(err, "Unable to read config file")
-
-  var dat map[string]interface{}
-  err = json.Unmarshal(payload, &dat)
-  CheckForError(err, "Invalid JSON in config file")
-
-  // probably a better way to unmarshall directly in the Properties struct but I haven't found it
-  var rtn = Properties {
-    Hostname: dat["Hostname"].(string),
-    Port: dat["Port"].(string),
-    JSONEndpointPort: dat["JSONEndpointPort"].(string),
-    HasEnteredTheRoomMessage: dat["HasEnteredTheRoomMessage"].(string),
-    HasLeftTheRoomMessage: dat["HasLeftTheRoomMessage"].(string),
-    HasEnteredTheLobbyMessage: dat["HasEnteredTheLobbyMessage"].(string),
-    HasLeftTheLobbyMessage: dat["HasLeftTheLobbyMessage"].(string),
-    ReceivedAMessage: dat["ReceivedAMessage"].(string),
-    IgnoringMessage: dat["IgnoringMessage"].(string),
-    LogFile: dat["LogFile"].(string),
-  }
-  config = rtn;
-  return rtn;
-}
+var clientsLock sync.RWMutex
 
 // remove client entry from stored clients
 func removeEntry(client *Client, arr []*Client) []*Client {
@@ -158,6 +222,33 @@ func removeEntry(client *Client, arr []*Client) []*Client {
   return rtn;
 }
 
+// return the currently connected clients
+func ConnectedClients() []*Client {
+  clientsLock.RLock()
+  defer clientsLock.RUnlock()
+  return clients
+}
+
+// return the connected clients with the username
+func FindClients(username string) []*Client {
+  rtn := []*Client{}
+  for _, client := range ConnectedClients() {
+    if name, _ := client.Identity(); name == username {
+      rtn = append(rtn, client)
+    }
+  }
+  return rtn
+}
+
+// return the IP address (without the port) of the remote end of a connection
+func RemoteIP(conn net.Conn) string {
+  host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+  if (err != nil) {
+    return conn.RemoteAddr().String()
+  }
+  return host
+}
+
 // sent a message to all clients (except the sender)
 func SendClientMessage(messageType string, message string, client *Client, thisClientOnly bool, props Properties) {
 
@@ -166,28 +257,72 @@ func SendClientMessage(messageType string, message string, client *Client, thisC
     message = fmt.Sprintf("/%v", messageType);
     fmt.Fprintln(client.Connection, message)
 
-  } else if (client.Username != "") {
+  } else if username, _ := client.Identity(); username != "" {
     // this message is for all but the provided client
-    LogAction(messageType, message, client, props);
+    BroadcastAction(Action{Command: messageType, Content: message}, client, props)
+  }
+}
 
-    // construct the payload to be sent to clients
-    payload := fmt.Sprintf("/%v [%v] %v", messageType, client.Username, message);
+// log an action performed by the client and send it to all (non anonymous) clients
+// room actions (like "message") are only sent to clients in the room of the action
+// the room's plugins can rewrite or reject the action first (false is returned if it was rejected)
+func BroadcastAction(entry Action, client *Client, props Properties) (Action, bool) {
+  username, room := client.Identity()
+  if (entry.Room == "") {
+    entry.Room = room
+  }
 
-    for _, _client := range clients {
-      // write the message to the client
-      if ((thisClientOnly && _client.Username == client.Username) ||
-          (!thisClientOnly && _client.Username != "")) {
+  recipients := []*Client{}
+  for _, _client := range ConnectedClients() {
+    recipientName, recipientRoom := _client.Identity()
+    // you won't hear any activity if you are anonymous
+    if (recipientName == "") {
+      continue
+    }
+
+    // you should only see a message if you are in the same room
+    if (ROOM_ACTIONS[entry.Command] && entry.Room != recipientRoom || _client.IsIgnoring(username)) {
+      continue;
+    }
+    recipients = append(recipients, _client)
+  }
 
-        // you should only see a message if you are in the same room
-        if (messageType == "message" && client.Room != _client.Room || _client.IsIgnoring(client.Username)) {
-          continue;
-        }
+  entry, recipients, ok := PreBroadcast(entry, recipients, client, props)
+  if (!ok) {
+    return entry, false
+  }
+  action := LogClientAction(entry, client, props)
+  shown := shownAction(action)
+  for _, recipient := range recipients {
+    SendClientAction(shown.Command, shown, recipient)
+  }
+  return action, true
+}
 
-        // you won't hear any activity if you are anonymous unless thisClientOnly
-        // when current client will *only* be messaged
-        fmt.Fprintln(_client.Connection, payload)
-      }
+// send a previously logged action to only the provided client
+// the action id and timestamp are included if the client understands them
+// replies are sent as "/reply [{username}] {{id} {time}} {parent id} {message}" (or a plain message to older clients)
+func SendClientAction(messageType string, action Action, client *Client) {
+  if (client.Protocol >= PROTOCOL_VERSION) {
+    body := action.Body()
+    if (messageType == "message" && action.Target != 0) {
+      messageType = "reply"
+      body = fmt.Sprintf("%v %v", action.Target, action.Content)
     }
+    fmt.Fprintf(client.Connection, "/%v [%v] {%v %v} %v\n",
+      messageType, action.Username, action.ID, action.UnixTime(), body)
+  } else {
+    fmt.Fprintf(client.Connection, "/%v [%v] %v\n", messageType, action.Username, action.Body())
+  }
+}
+
+// send a "/{messageType} [{username}] {message}" response to only the provided client
+// (the username is left out if empty)
+func SendClientResponse(messageType string, username string, message string, client *Client) {
+  if (username == "") {
+    fmt.Fprintf(client.Connection, "/%v %v\n", messageType, message)
+  } else {
+    fmt.Fprintf(client.Connection, "/%v [%v] %v\n", messageType, username, message)
   }
 }
 
@@ -199,11 +334,6 @@ func CheckForError(err error, message string) {
   }
 }
 
-// double quote the single quotes
-func EncodeCSV(value string) (string) {
-  return strings.Replace(value, "\"", "\"\"", -1)
-}
-
 // simple http-ish encoding to handle special characters
 func Encode(value string) (string) {
   return replace(ENCODING_UNENCODED_TOKENS, ENCODING_ENCODED_TOKENS, value)
@@ -232,41 +362,83 @@ func replace(fromTokens []string, toTokens []string, value string) (string) {
 //   - "ignore": ignore a user
 // message: message/context appropriate for the action
 // client: the initiating client
-func LogAction(action string, message string, client *Client, props Properties) {
-  ip := client.Connection.RemoteAddr().String()
-  timestamp := time.Now().Format(TIME_LAYOUT)
+// the logged action is returned
+func LogAction(action string, message string, client *Client, props Properties) Action {
+  return LogClientAction(Action{Command: action, Content: message}, client, props)
+}
+
+// log an action (with the command, content and optional target) performed by the client
+// the user, ip and timestamp are set from the client and the room is the client's room unless provided
+func LogClientAction(entry Action, client *Client, props Properties) Action {
+  username, room := client.Identity()
+  entry.Username = username
+  entry.IP = client.Connection.RemoteAddr().String()
+  entry.Timestamp = time.Now().Format(TIME_LAYOUT)
+  entry.Source = client.source
+  if (entry.Room == "") {
+    entry.Room = room
+  }
 
   // keep track of the actions to query against for the JSON endpoing
-  actions = append(actions, Action {
-    Command: action,
-    Content: message,
-    Username: client.Username,
-    IP: ip,
-    Timestamp: timestamp,
-  })
+  entry = addAction(entry)
 
   if (props.LogFile != "") {
-    if (message == "") {
-      message = "N/A"
+    Debugf("logging values %s, %s, %s", entry.Command, entry.Content, username)
+
+    // a failed write is reported but doesn't stop the server (like a failed sync)
+    if err := writeLog(entry, props); err != nil {
+      Errorf("Can't write to log file %s: %v", props.LogFile, err)
     }
-    fmt.Printf("logging values %s, %s, %s\n", action, message, client.Username);
-
-    logMessage := fmt.Sprintf("\"%s\", \"%s\", \"%s\", \"%s\", \"%s\"\n",
-      EncodeCSV(client.Username), EncodeCSV(action), EncodeCSV(message),
-        EncodeCSV(timestamp), EncodeCSV(ip))
-
-    f, err := os.OpenFile(props.LogFile, os.O_APPEND|os.O_WRONLY, 0600)
-    if (err != nil) {
-      // try to create it
-      err = ioutil.WriteFile(props.LogFile, []byte{}, 0600)
-      f, err = os.OpenFile(props.LogFile, os.O_APPEND|os.O_WRONLY, 0600)
-      CheckForError(err, "Cant create log file")
+  }
+  postLog(entry, client, props)
+  sendWebhooks(entry, props)
+  return entry
+}
+
+// add an action to the query store (and the search index)
+// the action is given the next id unless it already has one (imported actions)
+func addAction(action Action) Action {
+  actionsLock.Lock()
+  if (action.ID == 0) {
+    action.ID = nextActionID
+  }
+  if (action.ID >= nextActionID) {
+    nextActionID = action.ID + 1
+  }
+  actions = append(actions, action)
+  doc := len(actions) - 1
+  revised, previousContent := trackMessage(doc, action)
+  // the index is updated while holding the lock (always taken before the index lock) so concurrent edits
+  // of a message are applied to the index in the same order as to the message
+  indexAction(doc, action)
+  if (revised >= 0) {
+    // the search index should only have the current version of the message
+    index.remove(revised, Decode(previousContent))
+    if (action.Command == "edit") {
+      index.add(revised, Decode(action.Content))
     }
+  }
+  // published while holding the lock so subscribers get actions in id order
+  publishAction(action)
+  actionsLock.Unlock()
+  return action
+}
+
+// the content sent to clients (prefixed with the target message id for actions like "edit")
+func (action Action) Body() string {
+  if (action.Target != 0 && action.Command != "message") {
+    return fmt.Sprintf("%v %v", action.Target, action.Content)
+  }
+  return action.Content
+}
 
-    defer f.Close()
-    _, err = f.WriteString(logMessage)
-    CheckForError(err, "Can't write to log file")
+// return when the action happened (as unix seconds)
+func (action Action) UnixTime() int64 {
+  timestamp, err := time.Parse(TIME_LAYOUT, action.Timestamp)
+  if (err != nil) {
+    return 0
   }
+  return timestamp.Unix()
 }
 
 func QueryMessages(actionType string, search string, username string) ([]Action) {
@@ -284,6 +456,8 @@ func QueryMessages(actionType string, search string, username string) ([]Action)
     return true;
   }
 
+  actionsLock.RLock()
+  defer actionsLock.RUnlock()
   rtn := make([]Action, 0, len(actions))
 
   // find out which items match the search criteria and add them to what we will be returning
@@ -295,3 +469,30 @@ func QueryMessages(actionType string, search string, username string) ([]Action)
 
   return rtn;
 }
+
+// return the most recent chat messages sent to a room (oldest first)
+// messages have their current (edited) content and deleted messages are not included
+// only the last "limit" messages are returned (if > 0)
+func QueryRoomMessages(room string, limit int) ([]Action) {
+  actionsLock.RLock()
+  defer actionsLock.RUnlock()
+  rtn := []Action{}
+
+  // work backwards so we can stop once we have enough
+  for i := len(actions) - 1; i >= 0; i-- {
+    if (limit > 0 && len(rtn) >= limit) {
+      break
+    }
+    if (actions[i].Command == "message" && actions[i].Room == room) {
+      if message, ok := currentMessage(actions[i]); ok {
+        rtn = append(rtn, message)
+      }
+    }
+  }
+
+  // put them back in chronological order
+  for i, j := 0, len(rtn) - 1; i < j; i, j = i + 1, j - 1 {
+    rtn[i], rtn[j] = rtn[j], rtn[i]
+  }
+  return rtn;
+}
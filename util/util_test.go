@@ -0,0 +1,55 @@
+package util
+
+import (
+  "bufio"
+  "io"
+  "net"
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestCloseOnlyDisconnectsOnce(t *testing.T) {
+  loadTestConfig(t, `{}`)
+  server, other := net.Pipe()
+  go io.Copy(io.Discard, other)
+  watcherServer, watcherOther := net.Pipe()
+  defer watcherServer.Close()
+
+  client := &Client{Connection: server, Username: "joe", Room: LOBBY}
+  watcher := &Client{Connection: watcherServer, Username: "ann", Room: LOBBY}
+  client.Register()
+  watcher.Register()
+  defer watcher.disconnect(false)
+
+  lines := make(chan string, 10)
+  go func() {
+    scanner := bufio.NewScanner(watcherOther)
+    for scanner.Scan() {
+      lines <- scanner.Text()
+    }
+  }()
+
+  // flooding closes the client and then the lost connection closes it again
+  client.Close(true)
+  client.Close(true)
+  if (client.IsConnected()) {
+    t.Errorf("expected the client to be removed")
+  }
+
+  disconnects := 0
+  timeout := time.After(200 * time.Millisecond)
+  for done := false; !done; {
+    select {
+      case line := <-lines:
+        if (strings.HasPrefix(line, "/disconnect")) {
+          disconnects++
+        }
+      case <-timeout:
+        done = true
+    }
+  }
+  if (disconnects != 1) {
+    t.Errorf("expected 1 disconnect to be sent but there were %d", disconnects)
+  }
+}
@@ -0,0 +1,327 @@
+package util
+
+import (
+  "bytes"
+  "crypto/hmac"
+  "crypto/sha256"
+  "crypto/subtle"
+  "encoding/hex"
+  "encoding/json"
+  "fmt"
+  "io"
+  "net"
+  "net/http"
+  "os"
+  "regexp"
+  "sync"
+  "time"
+)
+
+// header with the HMAC-SHA256 of the payload ("sha256={hex digest}") when the webhook has a secret
+const WEBHOOK_SIGNATURE_HEADER = "X-Chat-Signature"
+// header with the action command ("message", "enter", ...)
+const WEBHOOK_EVENT_HEADER = "X-Chat-Event"
+// number of deliveries that can be waiting to be sent (deliveries that don't fit go to the WebhookDeadLetterFile)
+const WEBHOOK_QUEUE_SIZE = 1000
+// number of deliveries sent at the same time
+const WEBHOOK_WORKERS = 4
+
+// an outgoing webhook - matching actions are POSTed to the URL as JSON
+// the filters are ignored if empty (direct messages are only sent if "direct" is in Commands)
+type Webhook struct {
+  URL string                `json:"URL"`
+  // key used to sign the payload (the payload isn't signed if empty)
+  Secret string             `json:"Secret"`
+  // only send these actions ("message", "enter", ...)
+  Commands []string         `json:"Commands"`
+  // only send actions in these rooms
+  Rooms []string            `json:"Rooms"`
+  // only send actions by these users
+  Users []string            `json:"Users"`
+  // only send actions whose content matches this regular expression
+  Pattern string            `json:"Pattern"`
+}
+
+// what is POSTed to a webhook
+type WebhookPayload struct {
+  Room string               `json:"room"`
+  Action Action             `json:"action"`
+}
+
+// a webhook delivery that failed after every retry (written to the WebhookDeadLetterFile as a JSON line)
+type deadLetter struct {
+  URL string                `json:"url"`
+  Error string              `json:"error"`
+  Attempts int              `json:"attempts"`
+  Timestamp string          `json:"timestamp"`
+  Payload json.RawMessage   `json:"payload"`
+}
+
+// an action waiting to be sent to a webhook
+type webhookDelivery struct {
+  hook Webhook
+  action Action
+  props Properties
+}
+
+// compiled webhook patterns
+var webhookPatterns = map[string]*regexp.Regexp{}
+var webhookPatternsLock sync.Mutex
+// guards the dead letter file
+var deadLetterLock sync.Mutex
+// deliveries waiting for a worker (the workers are started with the first delivery)
+var webhookQueue = make(chan webhookDelivery, WEBHOOK_QUEUE_SIZE)
+var webhookWorkers sync.Once
+// what WebhookRetryDelay is counted in
+var webhookDelayUnit = time.Second
+
+// return true if the webhook's filters match the action
+func (hook Webhook) Matches(action Action) bool {
+  if (len(hook.Commands) > 0 && !containsString(hook.Commands, action.Command)) {
+    return false
+  }
+  if (action.Command == "direct" && !containsString(hook.Commands, "direct")) {
+    return false
+  }
+  if (len(hook.Rooms) > 0 && !containsString(hook.Rooms, action.Room)) {
+    return false
+  }
+  if (len(hook.Users) > 0 && !containsString(hook.Users, action.Username)) {
+    return false
+  }
+  if (hook.Pattern != "") {
+    pattern, err := webhookPattern(hook.Pattern)
+    if (err != nil || !pattern.MatchString(Decode(action.Content))) {
+      return false
+    }
+  }
+  return true
+}
+
+// return the compiled pattern (patterns are checked when the config is loaded)
+func webhookPattern(pattern string) (*regexp.Regexp, error) {
+  webhookPatternsLock.Lock()
+  defer webhookPatternsLock.Unlock()
+  if compiled, ok := webhookPatterns[pattern]; ok {
+    return compiled, nil
+  }
+  compiled, err := regexp.Compile(pattern)
+  if (err == nil) {
+    webhookPatterns[pattern] = compiled
+  }
+  return compiled, err
+}
+
+// send the action to every matching webhook (in the background)
+func sendWebhooks(action Action, props Properties) {
+  webhookWorkers.Do(func() {
+    for i := 0; i < WEBHOOK_WORKERS; i++ {
+      go deliverWebhooks(webhookQueue)
+    }
+  })
+  for _, hook := range props.Webhooks {
+    if (hook.Matches(action)) {
+      queueWebhook(webhookQueue, webhookDelivery{hook: hook, action: action, props: props})
+    }
+  }
+}
+
+// add a delivery to the queue without waiting (it is written to the dead letter file if the queue is full)
+func queueWebhook(queue chan webhookDelivery, delivery webhookDelivery) {
+  select {
+    case queue <- delivery:
+    default:
+      Warnf("Webhook queue is full, not sending %s to %s", delivery.action.Command, delivery.hook.URL)
+      payload, err := webhookPayload(delivery.action)
+      if (err != nil) {
+        Errorf("Can't encode webhook payload: %v", err)
+        return
+      }
+      writeDeadLetter(deadLetter{URL: delivery.hook.URL, Error: "queue full", Attempts: 0,
+          Timestamp: time.Now().Format(TIME_LAYOUT), Payload: payload}, delivery.props)
+  }
+}
+
+// send the queued deliveries one at a time
+func deliverWebhooks(queue chan webhookDelivery) {
+  for delivery := range queue {
+    DeliverWebhook(delivery.hook, delivery.action, delivery.props)
+  }
+}
+
+// the JSON POSTed to webhooks for the action
+func webhookPayload(action Action) ([]byte, error) {
+  return json.Marshal(WebhookPayload{Room: action.Room, Action: action})
+}
+
+// POST the action to the webhook, retrying WebhookRetries times (waiting WebhookRetryDelay seconds and then
+// twice as long after each attempt) if it can't be reached or answers with a 5xx or 429 status
+// deliveries that fail are written to the WebhookDeadLetterFile and the last error is returned
+func DeliverWebhook(hook Webhook, action Action, props Properties) error {
+  payload, err := webhookPayload(action)
+  if (err != nil) {
+    return err
+  }
+
+  client := http.Client{Timeout: time.Duration(props.WebhookTimeout) * time.Second}
+  delay := time.Duration(props.WebhookRetryDelay) * webhookDelayUnit
+  attempts := 0
+  for {
+    attempts++
+    var retry bool
+    retry, err = postWebhook(client, hook, action, payload)
+    if (err == nil) {
+      return nil
+    }
+    if (!retry || attempts > props.WebhookRetries) {
+      break
+    }
+    Debugf("Webhook %s failed (%v), retrying in %v", hook.URL, err, delay)
+    time.Sleep(delay)
+    delay *= 2
+  }
+
+  Warnf("Webhook %s failed after %d attempts: %v", hook.URL, attempts, err)
+  writeDeadLetter(deadLetter{URL: hook.URL, Error: err.Error(), Attempts: attempts,
+      Timestamp: time.Now().Format(TIME_LAYOUT), Payload: payload}, props)
+  return err
+}
+
+// make one attempt to deliver the payload (retry is true if it is worth trying again)
+func postWebhook(client http.Client, hook Webhook, action Action, payload []byte) (retry bool, err error) {
+  request, err := http.NewRequest("POST", hook.URL, bytes.NewReader(payload))
+  if (err != nil) {
+    return false, err
+  }
+  request.Header.Set("Content-Type", "application/json")
+  request.Header.Set(WEBHOOK_EVENT_HEADER, action.Command)
+  if (hook.Secret != "") {
+    request.Header.Set(WEBHOOK_SIGNATURE_HEADER, "sha256=" + WebhookSignature(hook.Secret, payload))
+  }
+
+  response, err := client.Do(request)
+  if (err != nil) {
+    return true, err
+  }
+  response.Body.Close()
+  if (response.StatusCode < 200 || response.StatusCode > 299) {
+    retry := response.StatusCode >= 500 || response.StatusCode == http.StatusTooManyRequests
+    return retry, fmt.Errorf("status %s", response.Status)
+  }
+  return false, nil
+}
+
+// return the hex HMAC-SHA256 of the payload (what the signature header is checked against)
+func WebhookSignature(secret string, payload []byte) string {
+  mac := hmac.New(sha256.New, []byte(secret))
+  mac.Write(payload)
+  return hex.EncodeToString(mac.Sum(nil))
+}
+
+// add a failed delivery to the dead letter file
+func writeDeadLetter(letter deadLetter, props Properties) {
+  if (props.WebhookDeadLetterFile == "") {
+    return
+  }
+  line, err := json.Marshal(letter)
+  if (err != nil) {
+    Errorf("Can't encode webhook dead letter: %v", err)
+    return
+  }
+
+  deadLetterLock.Lock()
+  defer deadLetterLock.Unlock()
+  file, err := os.OpenFile(props.WebhookDeadLetterFile, os.O_APPEND | os.O_CREATE | os.O_WRONLY, 0600)
+  if (err != nil) {
+    Errorf("Can't open webhook dead letter file: %v", err)
+    return
+  }
+  defer file.Close()
+  if _, err := file.Write(append(line, '\n')); err != nil {
+    Errorf("Can't write webhook dead letter file: %v", err)
+  }
+}
+
+// where incoming webhook actions come from (Action.Source)
+const WEBHOOK_SOURCE = "webhook"
+// added to the names of incoming webhook messages so they can't pass for users ("webhook:ci")
+const WEBHOOK_NAME_PREFIX = "webhook:"
+
+// a client for messages posted to the incoming webhook endpoint (the username is the name with WEBHOOK_NAME_PREFIX)
+// it isn't connected so it doesn't receive anything (anything sent to it is discarded)
+func NewWebhookClient(name string, room string, remoteAddr string) *Client {
+  return &Client{Connection: virtualConn{addr: virtualAddr(remoteAddr)}, Username: WEBHOOK_NAME_PREFIX + name,
+      Room: room, Protocol: PROTOCOL_VERSION, source: WEBHOOK_SOURCE}
+}
+
+// return true if an incoming webhook can't use the name because it belongs to a connected user or to an admin
+// or moderator
+func IsReservedWebhookName(name string, props Properties) bool {
+  for _, username := range []string{name, WEBHOOK_NAME_PREFIX + name} {
+    if (len(FindClients(username)) > 0 || containsString(props.Admins, username) ||
+        containsString(props.Moderators, username)) {
+      return true
+    }
+  }
+  return false
+}
+
+// return true if the token is one of the IncomingWebhookTokens
+func IsWebhookToken(token string, props Properties) bool {
+  valid := false
+  for _, value := range props.IncomingWebhookTokens {
+    // compare every token the same way so the time taken doesn't give anything away
+    if (subtle.ConstantTimeCompare([]byte(value), []byte(token)) == 1) {
+      valid = true
+    }
+  }
+  return valid && token != ""
+}
+
+// the address of a client that isn't a chat connection
+type virtualAddr string
+
+func (addr virtualAddr) Network() string {
+  return WEBHOOK_SOURCE
+}
+
+func (addr virtualAddr) String() string {
+  return string(addr)
+}
+
+// a connection that discards what is written to it and has nothing to read
+type virtualConn struct {
+  addr net.Addr
+}
+
+func (conn virtualConn) Read(data []byte) (int, error) {
+  return 0, io.EOF
+}
+
+func (conn virtualConn) Write(data []byte) (int, error) {
+  return len(data), nil
+}
+
+func (conn virtualConn) Close() error {
+  return nil
+}
+
+func (conn virtualConn) LocalAddr() net.Addr {
+  return conn.addr
+}
+
+func (conn virtualConn) RemoteAddr() net.Addr {
+  return conn.addr
+}
+
+func (conn virtualConn) SetDeadline(t time.Time) error {
+  return nil
+}
+
+func (conn virtualConn) SetReadDeadline(t time.Time) error {
+  return nil
+}
+
+func (conn virtualConn) SetWriteDeadline(t time.Time) error {
+  return nil
+}
@@ -0,0 +1,207 @@
+package util
+
+import (
+  "bufio"
+  "crypto/hmac"
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "io"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "sync"
+  "testing"
+  "time"
+)
+
+// a webhook receiver answering with the statuses in turn (the last one is repeated)
+type receiver struct {
+  lock sync.Mutex
+  statuses []int
+  requests []*http.Request
+  bodies [][]byte
+  times []time.Time
+}
+
+func (receiver *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+  body, _ := io.ReadAll(r.Body)
+  receiver.lock.Lock()
+  defer receiver.lock.Unlock()
+  receiver.requests = append(receiver.requests, r)
+  receiver.bodies = append(receiver.bodies, body)
+  receiver.times = append(receiver.times, time.Now())
+  status := receiver.statuses[len(receiver.statuses) - 1]
+  if (len(receiver.requests) <= len(receiver.statuses)) {
+    status = receiver.statuses[len(receiver.requests) - 1]
+  }
+  w.WriteHeader(status)
+}
+
+func startReceiver(t *testing.T, statuses ...int) (*receiver, string) {
+  handler := &receiver{statuses: statuses}
+  server := httptest.NewServer(handler)
+  t.Cleanup(server.Close)
+  return handler, server.URL
+}
+
+// the properties for quick deliveries (writing dead letters to a temporary file)
+func webhookProps(t *testing.T, retries int) Properties {
+  webhookDelayUnit = 10 * time.Millisecond
+  t.Cleanup(func() {
+    webhookDelayUnit = time.Second
+  })
+  return Properties{WebhookRetries: retries, WebhookRetryDelay: 1, WebhookTimeout: 5,
+      WebhookDeadLetterFile: filepath.Join(t.TempDir(), "failed.jsonl")}
+}
+
+// return the dead letters written to the file
+func readDeadLetters(t *testing.T, path string) []deadLetter {
+  file, err := os.Open(path)
+  if (os.IsNotExist(err)) {
+    return nil
+  } else if (err != nil) {
+    t.Fatal(err)
+  }
+  defer file.Close()
+  rtn := []deadLetter{}
+  scanner := bufio.NewScanner(file)
+  for scanner.Scan() {
+    var letter deadLetter
+    if err := json.Unmarshal(scanner.Bytes(), &letter); err != nil {
+      t.Fatal(err)
+    }
+    rtn = append(rtn, letter)
+  }
+  return rtn
+}
+
+func TestWebhookIsSigned(t *testing.T) {
+  received, url := startReceiver(t, http.StatusOK)
+  hook := Webhook{URL: url, Secret: "s3cret"}
+  action := Action{ID: 7, Username: "joe", Command: "message", Content: "hello", Room: "ops"}
+  if err := DeliverWebhook(hook, action, webhookProps(t, 0)); err != nil {
+    t.Fatal(err)
+  }
+
+  mac := hmac.New(sha256.New, []byte("s3cret"))
+  mac.Write(received.bodies[0])
+  expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+  if actual := received.requests[0].Header.Get(WEBHOOK_SIGNATURE_HEADER); actual != expected {
+    t.Errorf("expected the signature %q but got %q", expected, actual)
+  }
+  if actual := received.requests[0].Header.Get(WEBHOOK_EVENT_HEADER); actual != "message" {
+    t.Errorf("expected the message event but got %q", actual)
+  }
+
+  var payload WebhookPayload
+  json.Unmarshal(received.bodies[0], &payload)
+  if (payload.Room != "ops" || payload.Action.ID != 7) {
+    t.Errorf("unexpected payload %s", received.bodies[0])
+  }
+}
+
+func TestWebhookWithoutSecretIsntSigned(t *testing.T) {
+  received, url := startReceiver(t, http.StatusOK)
+  DeliverWebhook(Webhook{URL: url}, Action{Command: "enter"}, webhookProps(t, 0))
+  if actual := received.requests[0].Header.Get(WEBHOOK_SIGNATURE_HEADER); actual != "" {
+    t.Errorf("expected no signature but got %q", actual)
+  }
+}
+
+func TestWebhookFilters(t *testing.T) {
+  message := Action{Username: "joe", Command: "message", Content: Encode("the site is down: outage"), Room: "ops"}
+  direct := Action{Username: "joe", Command: "direct", Content: "psst", Room: "ops"}
+  tests := []struct {
+    hook Webhook
+    action Action
+    expected bool
+  }{
+    {Webhook{}, message, true},
+    {Webhook{Commands: []string{"message"}}, message, true},
+    {Webhook{Commands: []string{"enter"}}, message, false},
+    {Webhook{Rooms: []string{"ops"}}, message, true},
+    {Webhook{Rooms: []string{"lobby"}}, message, false},
+    {Webhook{Users: []string{"ann"}}, message, false},
+    {Webhook{Pattern: "(?i)OUTAGE"}, message, true},
+    {Webhook{Pattern: "sev1"}, message, false},
+    {Webhook{}, direct, false},
+    {Webhook{Commands: []string{"direct"}}, direct, true},
+  }
+  for i, test := range tests {
+    if actual := test.hook.Matches(test.action); actual != test.expected {
+      t.Errorf("test %d: expected %v but got %v", i, test.expected, actual)
+    }
+  }
+}
+
+func TestWebhookRetriesWithBackoff(t *testing.T) {
+  received, url := startReceiver(t, http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK)
+  props := webhookProps(t, 5)
+  if err := DeliverWebhook(Webhook{URL: url}, Action{Command: "message"}, props); err != nil {
+    t.Fatal(err)
+  }
+  if (len(received.times) != 3) {
+    t.Fatalf("expected 3 attempts but there were %d", len(received.times))
+  }
+  first := received.times[1].Sub(received.times[0])
+  second := received.times[2].Sub(received.times[1])
+  if (first < 10 * time.Millisecond || second < 20 * time.Millisecond) {
+    t.Errorf("expected the delay to double but waited %v and then %v", first, second)
+  }
+  if letters := readDeadLetters(t, props.WebhookDeadLetterFile); len(letters) != 0 {
+    t.Errorf("expected no dead letters but got %v", letters)
+  }
+}
+
+func TestWebhookClientErrorsArentRetried(t *testing.T) {
+  received, url := startReceiver(t, http.StatusBadRequest)
+  props := webhookProps(t, 5)
+  if err := DeliverWebhook(Webhook{URL: url}, Action{Command: "message"}, props); err == nil {
+    t.Errorf("expected an error")
+  }
+  if (len(received.requests) != 1) {
+    t.Errorf("expected 1 attempt but there were %d", len(received.requests))
+  }
+}
+
+func TestWebhookDeadLetter(t *testing.T) {
+  _, url := startReceiver(t, http.StatusInternalServerError)
+  props := webhookProps(t, 1)
+  DeliverWebhook(Webhook{URL: url}, Action{ID: 3, Command: "message", Content: "hello"}, props)
+
+  letters := readDeadLetters(t, props.WebhookDeadLetterFile)
+  if (len(letters) != 1) {
+    t.Fatalf("expected 1 dead letter but got %d", len(letters))
+  }
+  if (letters[0].URL != url || letters[0].Attempts != 2 || letters[0].Error == "") {
+    t.Errorf("unexpected dead letter %+v", letters[0])
+  }
+  var payload WebhookPayload
+  json.Unmarshal(letters[0].Payload, &payload)
+  if (payload.Action.ID != 3 || payload.Action.Content != "hello") {
+    t.Errorf("unexpected dead letter payload %s", letters[0].Payload)
+  }
+}
+
+func TestWebhookQueueFull(t *testing.T) {
+  props := webhookProps(t, 0)
+  queue := make(chan webhookDelivery, 1)
+  hook := Webhook{URL: "http://localhost/hook"}
+  queueWebhook(queue, webhookDelivery{hook: hook, action: Action{ID: 1, Command: "message"}, props: props})
+  queueWebhook(queue, webhookDelivery{hook: hook, action: Action{ID: 2, Command: "message"}, props: props})
+
+  if (len(queue) != 1) {
+    t.Errorf("expected 1 queued delivery but there were %d", len(queue))
+  }
+  letters := readDeadLetters(t, props.WebhookDeadLetterFile)
+  if (len(letters) != 1 || letters[0].Error != "queue full" || letters[0].Attempts != 0) {
+    t.Fatalf("expected a queue full dead letter but got %+v", letters)
+  }
+  var payload WebhookPayload
+  json.Unmarshal(letters[0].Payload, &payload)
+  if (payload.Action.ID != 2) {
+    t.Errorf("expected the second delivery to be dead lettered but got %s", letters[0].Payload)
+  }
+}